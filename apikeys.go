@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// API key scopes. ScopeAdmin grants every other scope.
+const (
+	ScopeReadLists  = "read:lists"
+	ScopeWriteLists = "write:lists"
+	ScopeReadLeads  = "read:leads"
+	ScopeWriteLeads = "write:leads"
+	ScopeVerify     = "verify"
+	ScopeAdmin      = "admin"
+	// ScopeSuperAdmin is needed for operations that span workspaces, such as creating
+	// workspaces and tuning rate limits. It is not implied by ScopeAdmin.
+	ScopeSuperAdmin = "superadmin"
+)
+
+var allScopes = []string{ScopeReadLists, ScopeWriteLists, ScopeReadLeads, ScopeWriteLeads, ScopeVerify, ScopeAdmin, ScopeSuperAdmin}
+
+// APIKey is a credential for the API. Only a hash of the key is stored, the key
+// itself is returned once when it is created. Requests made with the key only see
+// the data of its workspace.
+type APIKey struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	WorkspaceID primitive.ObjectID `bson:"workspace_id" json:"workspace_id"`
+	Name        string             `bson:"name" json:"name"`
+	Prefix      string             `bson:"prefix" json:"prefix"`
+	Hash        string             `bson:"hash" json:"-"`
+	Scopes      []string           `bson:"scopes" json:"scopes"`
+	CreatedAt   time.Time          `bson:"created_at" json:"created_at"`
+	RevokedAt   *time.Time         `bson:"revoked_at,omitempty" json:"revoked_at,omitempty"`
+}
+
+// HasScope reports whether the key grants scope
+func (k APIKey) HasScope(scope string) bool {
+	if scope == ScopeSuperAdmin {
+		return slices.Contains(k.Scopes, ScopeSuperAdmin)
+	}
+	return slices.Contains(k.Scopes, ScopeAdmin) || slices.Contains(k.Scopes, ScopeSuperAdmin) || slices.Contains(k.Scopes, scope)
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// generateAPIKey returns a new random key such as "ev_3f9c..."
+func generateAPIKey() (string, error) {
+	b := make([]byte, 24)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return "ev_" + hex.EncodeToString(b), nil
+}
+
+// CreateAPIKey stores a new key with the given scopes and returns it along with the key itself
+func CreateAPIKey(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, name string, scopes []string) (APIKey, string, error) {
+	key, err := generateAPIKey()
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	apiKey, err := insertAPIKey(ctx, client, workspaceID, name, scopes, key)
+	return apiKey, key, err
+}
+
+func insertAPIKey(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, name string, scopes []string, key string) (APIKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	for _, scope := range scopes {
+		if !slices.Contains(allScopes, scope) {
+			return APIKey{}, errors.New("unknown scope: " + scope)
+		}
+	}
+	apiKey := APIKey{
+		WorkspaceID: workspaceID,
+		Name:        name,
+		Prefix:      key[:min(len(key), 11)],
+		Hash:        hashAPIKey(key),
+		Scopes:      scopes,
+		CreatedAt:   time.Now(),
+	}
+	collection := client.Database(config.Database).Collection("api_keys")
+	res, err := collection.InsertOne(ctx, apiKey)
+	if err != nil {
+		return APIKey{}, err
+	}
+	apiKey.ID = res.InsertedID.(primitive.ObjectID)
+	return apiKey, nil
+}
+
+func GetAPIKeys(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID) ([]APIKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("api_keys")
+	cursor, err := collection.Find(ctx, bson.M{"workspace_id": workspaceID})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var keys []APIKey
+	for cursor.Next(ctx) {
+		var key APIKey
+		cursor.Decode(&key)
+		keys = append(keys, key)
+	}
+	return keys, cursor.Err()
+}
+
+// RevokeAPIKey disables the key, requests made with it are rejected from then on
+func RevokeAPIKey(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, id primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("api_keys")
+	res, err := collection.UpdateOne(ctx, bson.M{"_id": id, "workspace_id": workspaceID, "revoked_at": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"revoked_at": time.Now()}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// FindAPIKey returns the active key matching key
+func FindAPIKey(ctx context.Context, client *mongo.Client, key string) (APIKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("api_keys")
+	var apiKey APIKey
+	err := collection.FindOne(ctx, bson.M{"hash": hashAPIKey(key), "revoked_at": bson.M{"$exists": false}}).Decode(&apiKey)
+	return apiKey, err
+}
+
+// EnsureBootstrapAPIKey stores key as a superadmin key of the default workspace unless it
+// already exists, so a fresh deployment has a key to create workspaces and other keys with
+func EnsureBootstrapAPIKey(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, key string) error {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("api_keys")
+	count, err := collection.CountDocuments(ctx, bson.M{"hash": hashAPIKey(key)})
+	if err != nil || count > 0 {
+		return err
+	}
+	_, err = insertAPIKey(ctx, client, workspaceID, "bootstrap", []string{ScopeSuperAdmin}, key)
+	return err
+}
+
+type apiKeyContextKey struct{}
+
+// apiKeyFromContext returns the key the request was authenticated with
+func apiKeyFromContext(ctx context.Context) (APIKey, bool) {
+	apiKey, ok := ctx.Value(apiKeyContextKey{}).(APIKey)
+	return apiKey, ok
+}
+
+// requestAPIKey reads the key from the Authorization bearer token or the X-API-Key header
+func requestAPIKey(r *http.Request) string {
+	if token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+		return strings.TrimSpace(token)
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// authenticate rejects requests without a valid API key and tells the caller which key
+// was used through the X-API-Key-ID header
+func authenticate(client *mongo.Client, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := requestAPIKey(r)
+		if key == "" {
+			writeError(w, r, unauthorized("missing API key"))
+			return
+		}
+		apiKey, err := FindAPIKey(r.Context(), client, key)
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, unauthorized("invalid API key"))
+			return
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("X-API-Key-ID", apiKey.ID.Hex())
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, apiKey)))
+	})
+}
+
+// requireScope only lets requests through whose API key grants scope
+func requireScope(scope string, handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		apiKey, ok := apiKeyFromContext(r.Context())
+		if !ok || !apiKey.HasScope(scope) {
+			writeError(w, r, forbidden("API key lacks the "+scope+" scope"))
+			return
+		}
+		handle(w, r, ps)
+	}
+}
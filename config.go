@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the settings of the service. They are resolved in this order, later
+// sources overriding earlier ones: built-in defaults, the YAML config file, environment
+// variables, command line flags.
+type Config struct {
+	MongoURI   string `yaml:"mongo_uri"`
+	Database   string `yaml:"database"`
+	ListenAddr string `yaml:"listen_addr"`
+
+	// worker tuning
+	WorkerConcurrency int    `yaml:"worker_concurrency"`
+	QueueBatchSize    int    `yaml:"queue_batch_size"`
+	SMTPHelloName     string `yaml:"smtp_hello_name"`
+	SMTPFromEmail     string `yaml:"smtp_from_email"`
+
+	// deadlines for data layer operations
+	QueryTimeout  time.Duration `yaml:"query_timeout"`  // single document reads and writes and counts
+	BulkTimeout   time.Duration `yaml:"bulk_timeout"`   // operations over a whole list such as queueing, moving or deleting it
+	ImportTimeout time.Duration `yaml:"import_timeout"` // CSV uploads
+	ExportTimeout time.Duration `yaml:"export_timeout"` // CSV downloads
+
+	// how long shutdown waits for running requests and verifications before giving up on them
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+
+	// how long a trashed list is kept before it is purged for good
+	ListTrashRetention time.Duration `yaml:"list_trash_retention"`
+
+	// origins allowed to call the API from a browser, "*" allows any
+	CORSAllowedOrigins []string `yaml:"cors_allowed_origins"`
+	// admin API key created at startup if it doesn't exist yet, used to create the other keys
+	BootstrapAPIKey string `yaml:"bootstrap_api_key"`
+
+	// lowest level logged, one of debug, info, warn or error
+	LogLevel string `yaml:"log_level"`
+}
+
+// config is the configuration the service runs with, set once at startup by main
+var config = defaultConfig()
+
+func defaultConfig() Config {
+	return Config{
+		MongoURI:           "mongodb://localhost:27017/email",
+		Database:           "email_verify",
+		ListenAddr:         ":30001",
+		WorkerConcurrency:  10,
+		QueueBatchSize:     20,
+		SMTPHelloName:      "mx.google.com",
+		SMTPFromEmail:      "vivek@thinksurfmedia.info",
+		QueryTimeout:       10 * time.Second,
+		BulkTimeout:        2 * time.Minute,
+		ImportTimeout:      10 * time.Minute,
+		ExportTimeout:      10 * time.Minute,
+		ShutdownTimeout:    30 * time.Second,
+		ListTrashRetention: 30 * 24 * time.Hour,
+		// browsers may only call the API from origins that are configured
+		CORSAllowedOrigins: []string{},
+		LogLevel:           "info",
+	}
+}
+
+// configSetting ties a setting to its flag and environment variable
+type configSetting struct {
+	flag  string
+	env   string
+	usage string
+	set   func(cfg *Config, value string) error
+}
+
+var configSettings = []configSetting{
+	{"mongo-uri", "EMAIL_VERIFY_MONGO_URI", "MongoDB connection string", stringSetting(func(c *Config) *string { return &c.MongoURI })},
+	{"database", "EMAIL_VERIFY_DATABASE", "MongoDB database name", stringSetting(func(c *Config) *string { return &c.Database })},
+	{"listen-addr", "EMAIL_VERIFY_LISTEN_ADDR", "address the HTTP server listens on", stringSetting(func(c *Config) *string { return &c.ListenAddr })},
+	{"worker-concurrency", "EMAIL_VERIFY_WORKER_CONCURRENCY", "number of verifications running at once", intSetting(func(c *Config) *int { return &c.WorkerConcurrency })},
+	{"queue-batch-size", "EMAIL_VERIFY_QUEUE_BATCH_SIZE", "number of queue items the worker fetches at a time", intSetting(func(c *Config) *int { return &c.QueueBatchSize })},
+	{"smtp-hello-name", "EMAIL_VERIFY_SMTP_HELLO_NAME", "name sent in the SMTP EHLO command", stringSetting(func(c *Config) *string { return &c.SMTPHelloName })},
+	{"smtp-from-email", "EMAIL_VERIFY_SMTP_FROM_EMAIL", "address sent in the SMTP MAIL FROM command", stringSetting(func(c *Config) *string { return &c.SMTPFromEmail })},
+	{"query-timeout", "EMAIL_VERIFY_QUERY_TIMEOUT", "deadline for single document operations", durationSetting(func(c *Config) *time.Duration { return &c.QueryTimeout })},
+	{"bulk-timeout", "EMAIL_VERIFY_BULK_TIMEOUT", "deadline for operations over a whole list", durationSetting(func(c *Config) *time.Duration { return &c.BulkTimeout })},
+	{"import-timeout", "EMAIL_VERIFY_IMPORT_TIMEOUT", "deadline for CSV uploads", durationSetting(func(c *Config) *time.Duration { return &c.ImportTimeout })},
+	{"export-timeout", "EMAIL_VERIFY_EXPORT_TIMEOUT", "deadline for CSV downloads", durationSetting(func(c *Config) *time.Duration { return &c.ExportTimeout })},
+	{"shutdown-timeout", "EMAIL_VERIFY_SHUTDOWN_TIMEOUT", "how long to wait for requests and verifications to finish on shutdown", durationSetting(func(c *Config) *time.Duration { return &c.ShutdownTimeout })},
+	{"list-trash-retention", "EMAIL_VERIFY_LIST_TRASH_RETENTION", "how long a trashed list is kept before it is purged", durationSetting(func(c *Config) *time.Duration { return &c.ListTrashRetention })},
+	{"cors-allowed-origins", "EMAIL_VERIFY_CORS_ALLOWED_ORIGINS", "comma separated origins allowed to call the API from a browser", listSetting(func(c *Config) *[]string { return &c.CORSAllowedOrigins })},
+	{"bootstrap-api-key", "EMAIL_VERIFY_BOOTSTRAP_API_KEY", "admin API key created at startup if missing", stringSetting(func(c *Config) *string { return &c.BootstrapAPIKey })},
+	{"log-level", "EMAIL_VERIFY_LOG_LEVEL", "lowest level logged: debug, info, warn or error", stringSetting(func(c *Config) *string { return &c.LogLevel })},
+}
+
+func stringSetting(field func(*Config) *string) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		*field(cfg) = value
+		return nil
+	}
+}
+
+func listSetting(field func(*Config) *[]string) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		var values []string
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+		*field(cfg) = values
+		return nil
+	}
+}
+
+func intSetting(field func(*Config) *int) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", value)
+		}
+		*field(cfg) = n
+		return nil
+	}
+}
+
+func durationSetting(field func(*Config) *time.Duration) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		// days are accepted as in the API, e.g. "30d"
+		d, err := parseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration", value)
+		}
+		*field(cfg) = d
+		return nil
+	}
+}
+
+// LoadConfig resolves the configuration from the config file, the environment and the
+// command line arguments and validates it. The config file is given with -config or
+// EMAIL_VERIFY_CONFIG.
+func LoadConfig(args []string) (Config, error) {
+	fs := flag.NewFlagSet("email_verify", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv("EMAIL_VERIFY_CONFIG"), "path to a YAML config file (env EMAIL_VERIFY_CONFIG)")
+	flagValues := make(map[string]*string)
+	for _, setting := range configSettings {
+		flagValues[setting.flag] = fs.String(setting.flag, "", setting.usage+" (env "+setting.env+")")
+	}
+	err := fs.Parse(args)
+	if err != nil {
+		return Config{}, err
+	}
+
+	cfg := defaultConfig()
+
+	if *configPath != "" {
+		data, err := os.ReadFile(*configPath)
+		if err != nil {
+			return Config{}, fmt.Errorf("reading config file: %w", err)
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		err = decoder.Decode(&cfg)
+		// an empty file decodes to io.EOF and leaves the defaults alone
+		if err != nil && !errors.Is(err, io.EOF) {
+			return Config{}, fmt.Errorf("parsing config file %s: %w", *configPath, err)
+		}
+	}
+
+	for _, setting := range configSettings {
+		value, ok := os.LookupEnv(setting.env)
+		if !ok {
+			continue
+		}
+		err := setting.set(&cfg, value)
+		if err != nil {
+			return Config{}, fmt.Errorf("%s: %w", setting.env, err)
+		}
+	}
+
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		for _, setting := range configSettings {
+			if setting.flag == f.Name && flagErr == nil {
+				err := setting.set(&cfg, *flagValues[f.Name])
+				if err != nil {
+					flagErr = fmt.Errorf("-%s: %w", f.Name, err)
+				}
+			}
+		}
+	})
+	if flagErr != nil {
+		return Config{}, flagErr
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// Validate checks the configuration and reports every invalid setting at once
+func (cfg Config) Validate() error {
+	var errs []error
+	if !strings.HasPrefix(cfg.MongoURI, "mongodb://") && !strings.HasPrefix(cfg.MongoURI, "mongodb+srv://") {
+		errs = append(errs, errors.New("mongo_uri must start with mongodb:// or mongodb+srv://"))
+	}
+	if cfg.Database == "" || strings.ContainsAny(cfg.Database, "/\\. \"$") {
+		errs = append(errs, fmt.Errorf("database %q is not a valid MongoDB database name", cfg.Database))
+	}
+	if _, port, err := net.SplitHostPort(cfg.ListenAddr); err != nil || port == "" {
+		errs = append(errs, fmt.Errorf("listen_addr %q must be host:port or :port", cfg.ListenAddr))
+	}
+	if cfg.WorkerConcurrency < 1 {
+		errs = append(errs, errors.New("worker_concurrency must be at least 1"))
+	}
+	if cfg.QueueBatchSize < 1 {
+		errs = append(errs, errors.New("queue_batch_size must be at least 1"))
+	}
+	if cfg.SMTPHelloName == "" {
+		errs = append(errs, errors.New("smtp_hello_name must not be empty"))
+	}
+	if !strings.Contains(cfg.SMTPFromEmail, "@") {
+		errs = append(errs, fmt.Errorf("smtp_from_email %q is not an email address", cfg.SMTPFromEmail))
+	}
+	timeouts := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"query_timeout", cfg.QueryTimeout},
+		{"bulk_timeout", cfg.BulkTimeout},
+		{"import_timeout", cfg.ImportTimeout},
+		{"export_timeout", cfg.ExportTimeout},
+		{"shutdown_timeout", cfg.ShutdownTimeout},
+		{"list_trash_retention", cfg.ListTrashRetention},
+	}
+	for _, timeout := range timeouts {
+		if timeout.value <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive", timeout.name))
+		}
+	}
+	if cfg.BootstrapAPIKey != "" && len(cfg.BootstrapAPIKey) < 32 {
+		errs = append(errs, errors.New("bootstrap_api_key must be at least 32 characters long"))
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		errs = append(errs, errors.New("log_level must be debug, info, warn or error"))
+	}
+	return errors.Join(errs...)
+}
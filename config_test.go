@@ -0,0 +1,167 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfigFile writes content to a config file in a temporary directory and returns its path
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(path, []byte(content), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	file := writeConfigFile(t, "database: from_file\nworker_concurrency: 3\nquery_timeout: 20s\ncors_allowed_origins: [https://file.example]\n")
+	tests := []struct {
+		name  string
+		env   map[string]string
+		args  []string
+		check func(Config) bool
+	}{
+		{
+			name: "defaults",
+			check: func(c Config) bool {
+				return c.Database == "email_verify" && c.WorkerConcurrency == defaultConfig().WorkerConcurrency
+			},
+		},
+		{
+			name: "file overrides defaults",
+			args: []string{"-config", file},
+			check: func(c Config) bool {
+				return c.Database == "from_file" && c.WorkerConcurrency == 3 && c.QueryTimeout == 20*time.Second
+			},
+		},
+		{
+			name:  "config file from the environment",
+			env:   map[string]string{"EMAIL_VERIFY_CONFIG": file},
+			check: func(c Config) bool { return c.Database == "from_file" },
+		},
+		{
+			name: "environment overrides file",
+			env:  map[string]string{"EMAIL_VERIFY_DATABASE": "from_env", "EMAIL_VERIFY_CORS_ALLOWED_ORIGINS": "https://a.example, https://b.example"},
+			args: []string{"-config", file},
+			check: func(c Config) bool {
+				return c.Database == "from_env" && c.WorkerConcurrency == 3 && strings.Join(c.CORSAllowedOrigins, " ") == "https://a.example https://b.example"
+			},
+		},
+		{
+			name: "flags override environment",
+			env:  map[string]string{"EMAIL_VERIFY_DATABASE": "from_env", "EMAIL_VERIFY_WORKER_CONCURRENCY": "4"},
+			args: []string{"-config", file, "-database", "from_flag"},
+			check: func(c Config) bool {
+				return c.Database == "from_flag" && c.WorkerConcurrency == 4 && c.QueryTimeout == 20*time.Second
+			},
+		},
+		{
+			name: "durations in days",
+			env:  map[string]string{"EMAIL_VERIFY_LIST_TRASH_RETENTION": "7d"},
+			args: []string{"-bulk-timeout", "1d"},
+			check: func(c Config) bool {
+				return c.ListTrashRetention == 7*24*time.Hour && c.BulkTimeout == 24*time.Hour
+			},
+		},
+		{
+			name:  "an empty flag value is still set",
+			env:   map[string]string{"EMAIL_VERIFY_BOOTSTRAP_API_KEY": strings.Repeat("k", 32)},
+			args:  []string{"-bootstrap-api-key", ""},
+			check: func(c Config) bool { return c.BootstrapAPIKey == "" },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			cfg, err := LoadConfig(tt.args)
+			if err != nil {
+				t.Fatalf("LoadConfig(%q) returned %v", tt.args, err)
+			}
+			if !tt.check(cfg) {
+				t.Errorf("LoadConfig(%q) = %+v", tt.args, cfg)
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		args    []string
+		file    string
+		wantErr string
+	}{
+		{name: "unknown flag", args: []string{"-no-such-flag"}, wantErr: "no-such-flag"},
+		{name: "bad integer in the environment", env: map[string]string{"EMAIL_VERIFY_WORKER_CONCURRENCY": "many"}, wantErr: "EMAIL_VERIFY_WORKER_CONCURRENCY"},
+		{name: "bad duration flag", args: []string{"-query-timeout", "soon"}, wantErr: "-query-timeout"},
+		{name: "unknown key in the file", file: "no_such_key: 1\n", wantErr: "no_such_key"},
+		{name: "missing file", args: []string{"-config", "/does/not/exist.yaml"}, wantErr: "reading config file"},
+		{name: "invalid value", args: []string{"-worker-concurrency", "0"}, wantErr: "worker_concurrency must be at least 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			args := tt.args
+			if tt.file != "" {
+				args = append([]string{"-config", writeConfigFile(t, tt.file)}, args...)
+			}
+			_, err := LoadConfig(args)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("LoadConfig(%q) returned %v, want an error mentioning %q", args, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(*Config)
+		wantErr []string
+	}{
+		{name: "defaults are valid", change: func(c *Config) {}},
+		{name: "no CORS origins are valid", change: func(c *Config) { c.CORSAllowedOrigins = nil }},
+		{name: "mongo uri", change: func(c *Config) { c.MongoURI = "localhost:27017" }, wantErr: []string{"mongo_uri"}},
+		{name: "database name", change: func(c *Config) { c.Database = "a.b" }, wantErr: []string{"database"}},
+		{name: "listen address", change: func(c *Config) { c.ListenAddr = "8080" }, wantErr: []string{"listen_addr"}},
+		{name: "timeouts", change: func(c *Config) { c.QueryTimeout = 0; c.ListTrashRetention = -time.Hour }, wantErr: []string{"query_timeout", "list_trash_retention"}},
+		{name: "short bootstrap key", change: func(c *Config) { c.BootstrapAPIKey = "short" }, wantErr: []string{"bootstrap_api_key"}},
+		{
+			name:    "every problem is reported",
+			change:  func(c *Config) { c.WorkerConcurrency = 0; c.QueueBatchSize = 0; c.SMTPFromEmail = "nobody" },
+			wantErr: []string{"worker_concurrency", "queue_batch_size", "smtp_from_email"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			tt.change(&cfg)
+			err := cfg.Validate()
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Errorf("Validate() returned %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Validate() returned nil, want errors mentioning %q", tt.wantErr)
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Validate() returned %v, want it to mention %q", err, want)
+				}
+			}
+		})
+	}
+}
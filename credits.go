@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrInsufficientCredits is returned when a workspace's credits or monthly quota can't
+// cover the leads it tries to queue
+var ErrInsufficientCredits = errors.New("insufficient verification credits")
+
+// usage is counted per UTC day, days are stored as "2006-01-02"
+const usageDayLayout = "2006-01-02"
+
+// UsageDay is the number of verifications a workspace completed on one day
+type UsageDay struct {
+	Date          string `bson:"date" json:"date"`
+	Verifications int64  `bson:"verifications" json:"verifications"`
+}
+
+// Usage describes a workspace's balance and the verifications it used
+type Usage struct {
+	// nil when the workspace has unlimited credits
+	Credits       *int64 `json:"credits"`
+	MonthlyQuota  int64  `json:"monthly_quota"`
+	UsedThisMonth int64  `json:"used_this_month"`
+	// verifications that can still be queued, -1 when unlimited
+	Available int64      `json:"available"`
+	Queued    int64      `json:"queued"`
+	Days      []UsageDay `json:"days"`
+}
+
+func startOfMonth(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// GetUsage returns the balance of the workspace and its usage per day between from and to
+func GetUsage(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, from time.Time, to time.Time) (Usage, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	var usage Usage
+	workspace, err := GetWorkspace(ctx, client, workspaceID)
+	if err != nil {
+		return usage, err
+	}
+	usage.Credits = workspace.Credits
+	usage.MonthlyQuota = workspace.MonthlyQuota
+
+	usage.UsedThisMonth, err = usedSince(ctx, client, workspaceID, startOfMonth(time.Now()))
+	if err != nil {
+		return usage, err
+	}
+	usage.Queued, err = GetQueueCount(ctx, client, workspaceID)
+	if err != nil {
+		return usage, err
+	}
+	usage.Available = availableCredits(workspace, time.Now().UTC().Format(quotaMonthLayout))
+
+	collection := client.Database(config.Database).Collection("usage")
+	cursor, err := collection.Find(ctx, bson.M{
+		"workspace_id": workspaceID,
+		"date":         bson.M{"$gte": from.UTC().Format(usageDayLayout), "$lte": to.UTC().Format(usageDayLayout)},
+	}, options.Find().SetSort(bson.M{"date": 1}))
+	if err != nil {
+		return usage, err
+	}
+	defer cursor.Close(ctx)
+
+	usage.Days = []UsageDay{}
+	for cursor.Next(ctx) {
+		var day UsageDay
+		cursor.Decode(&day)
+		usage.Days = append(usage.Days, day)
+	}
+	return usage, cursor.Err()
+}
+
+// usedSince sums the verifications of the workspace from the day of since onwards
+func usedSince(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, since time.Time) (int64, error) {
+	collection := client.Database(config.Database).Collection("usage")
+	cursor, err := collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"workspace_id": workspaceID, "date": bson.M{"$gte": since.UTC().Format(usageDayLayout)}}}},
+		{{Key: "$group", Value: bson.M{"_id": nil, "total": bson.M{"$sum": "$verifications"}}}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var result struct {
+		Total int64 `bson:"total"`
+	}
+	if cursor.Next(ctx) {
+		cursor.Decode(&result)
+	}
+	return result.Total, cursor.Err()
+}
+
+// the monthly quota is counted per UTC calendar month, months are stored as "2006-01"
+const quotaMonthLayout = "2006-01"
+
+// availableCredits is what is left of the credits and the monthly quota, -1 when neither
+// is limited. Credits and quota of queued items are reserved already.
+func availableCredits(workspace Workspace, month string) int64 {
+	if workspace.Credits == nil && workspace.MonthlyQuota <= 0 {
+		return -1
+	}
+	available := int64(math.MaxInt64)
+	if workspace.Credits != nil {
+		available = *workspace.Credits
+	}
+	if workspace.MonthlyQuota > 0 {
+		used := int64(0)
+		if workspace.QuotaMonth == month {
+			used = workspace.QuotaUsed
+		}
+		available = min(available, workspace.MonthlyQuota-used)
+	}
+	// a balance lowered below what is reserved, or a quota lowered below what was used
+	return max(available, 0)
+}
+
+// quotaUsedExpr is the quota the workspace used in month; the counter of an earlier month starts over
+func quotaUsedExpr(month string) bson.M {
+	return bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$quota_month", month}}, bson.M{"$ifNull": bson.A{"$quota_used", 0}}, 0}}
+}
+
+// takeCredits takes n credits from the workspace matching filter and counts n
+// verifications against its monthly quota. Credits never drop below 0.
+func takeCredits(ctx context.Context, client *mongo.Client, filter bson.M, n int64) (bool, error) {
+	month := time.Now().UTC().Format(quotaMonthLayout)
+	collection := client.Database(config.Database).Collection("workspaces")
+	res, err := collection.UpdateOne(ctx, filter, mongo.Pipeline{{{Key: "$set", Value: bson.M{
+		// workspaces without credits are unlimited and have nothing to take from
+		"credits":     bson.M{"$cond": bson.A{bson.M{"$isNumber": "$credits"}, bson.M{"$max": bson.A{bson.M{"$subtract": bson.A{"$credits", n}}, 0}}, "$$REMOVE"}},
+		"quota_used":  bson.M{"$add": bson.A{quotaUsedExpr(month), n}},
+		"quota_month": month,
+	}}}})
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+// reserveCredits takes the credits and quota for verifying n leads up front, in a single
+// conditional update so concurrent callers can't both spend the last credits. It returns
+// ErrInsufficientCredits, reserving nothing, when the credits or the quota left can't cover n.
+func reserveCredits(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, n int) error {
+	if n == 0 {
+		return nil
+	}
+	month := time.Now().UTC().Format(quotaMonthLayout)
+	reserved, err := takeCredits(ctx, client, bson.M{"_id": workspaceID, "$expr": bson.M{"$and": bson.A{
+		bson.M{"$or": bson.A{bson.M{"$not": bson.A{bson.M{"$isNumber": "$credits"}}}, bson.M{"$gte": bson.A{"$credits", n}}}},
+		bson.M{"$or": bson.A{
+			bson.M{"$lte": bson.A{bson.M{"$ifNull": bson.A{"$monthly_quota", 0}}, 0}},
+			bson.M{"$lte": bson.A{bson.M{"$add": bson.A{quotaUsedExpr(month), n}}, "$monthly_quota"}},
+		}},
+	}}}, int64(n))
+	if err != nil || reserved {
+		return err
+	}
+	// tell a missing workspace apart from one that can't pay
+	_, err = GetWorkspace(ctx, client, workspaceID)
+	if err != nil {
+		return err
+	}
+	return ErrInsufficientCredits
+}
+
+// refundCredits gives back what was reserved for n queue items that were removed without
+// being verified. Quota reserved in an earlier month has run out with that month.
+func refundCredits(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, n int64) error {
+	if n == 0 {
+		return nil
+	}
+	month := time.Now().UTC().Format(quotaMonthLayout)
+	collection := client.Database(config.Database).Collection("workspaces")
+	_, err := collection.UpdateOne(ctx, bson.M{"_id": workspaceID}, mongo.Pipeline{{{Key: "$set", Value: bson.M{
+		"credits":    bson.M{"$cond": bson.A{bson.M{"$isNumber": "$credits"}, bson.M{"$add": bson.A{"$credits", n}}, "$$REMOVE"}},
+		"quota_used": bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$quota_month", month}}, bson.M{"$max": bson.A{bson.M{"$subtract": bson.A{"$quota_used", n}}, 0}}, "$quota_used"}},
+	}}}})
+	return err
+}
+
+// chargeVerification takes one credit from the workspace for a verification nothing was
+// reserved for, such as an item queued before credits were reserved, and counts it
+func chargeVerification(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID) error {
+	_, err := takeCredits(ctx, client, bson.M{"_id": workspaceID}, 1)
+	if err != nil {
+		return err
+	}
+	return countVerification(ctx, client, workspaceID)
+}
+
+// countVerification counts a verification in today's usage
+func countVerification(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID) error {
+	collection := client.Database(config.Database).Collection("usage")
+	_, err := collection.UpdateOne(ctx,
+		bson.M{"workspace_id": workspaceID, "date": time.Now().UTC().Format(usageDayLayout)},
+		bson.M{"$inc": bson.M{"verifications": 1}},
+		options.Update().SetUpsert(true))
+	return err
+}
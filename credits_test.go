@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestAvailableCredits(t *testing.T) {
+	credits := func(n int64) *int64 { return &n }
+	const month = "2026-10"
+	tests := []struct {
+		name      string
+		workspace Workspace
+		want      int64
+	}{
+		{"unlimited", Workspace{}, -1},
+		{"credits only", Workspace{Credits: credits(50)}, 50},
+		{"no credits left", Workspace{Credits: credits(0)}, 0},
+		{"overdrawn credits", Workspace{Credits: credits(-5)}, 0},
+		{"quota only", Workspace{MonthlyQuota: 100, QuotaMonth: month, QuotaUsed: 30}, 70},
+		{"quota used in an earlier month", Workspace{MonthlyQuota: 100, QuotaMonth: "2026-09", QuotaUsed: 100}, 100},
+		{"quota lowered below what was used", Workspace{MonthlyQuota: 10, QuotaMonth: month, QuotaUsed: 30}, 0},
+		{"credits lower than quota", Workspace{Credits: credits(20), MonthlyQuota: 100, QuotaMonth: month, QuotaUsed: 30}, 20},
+		{"quota lower than credits", Workspace{Credits: credits(500), MonthlyQuota: 100, QuotaMonth: month, QuotaUsed: 30}, 70},
+		{"overdrawn quota with credits", Workspace{Credits: credits(500), MonthlyQuota: 100, QuotaMonth: month, QuotaUsed: 120}, 0},
+		{"negative quota is no quota", Workspace{Credits: credits(5), MonthlyQuota: -1}, 5},
+	}
+	for _, tt := range tests {
+		if got := availableCredits(tt.workspace, month); got != tt.want {
+			t.Errorf("%s: availableCredits() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
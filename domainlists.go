@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	emailVerifier "github.com/AfterShip/email-verifier"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// kinds of custom domain lists, both override the verifier's own disposable domain list
+const (
+	DomainListDisposable = "disposable"
+	DomainListAllowlist  = "allowlist"
+)
+
+// sources of a domain's disposable verdict, see classifyDomain
+const (
+	DomainSourceDisposable = "custom_disposable"
+	DomainSourceAllowlist  = "custom_allowlist"
+	DomainSourceLibrary    = "library"
+	DomainSourceNone       = "none"
+)
+
+// reachability verdicts of the verifier
+const (
+	reachableYes     = "yes"
+	reachableNo      = "no"
+	reachableUnknown = "unknown"
+)
+
+// DomainListEntry puts a domain on the custom disposable list or the allowlist. A domain
+// is on at most one of them.
+type DomainListEntry struct {
+	Domain    string    `bson:"domain" json:"domain"`
+	Kind      string    `bson:"kind" json:"kind"`
+	Reason    string    `bson:"reason,omitempty" json:"reason,omitempty"`
+	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+func GetDomainListEntries(ctx context.Context, client *mongo.Client) ([]DomainListEntry, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("domain_lists")
+	cursor, err := collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"domain": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	entries := []DomainListEntry{}
+	for cursor.Next(ctx) {
+		var entry DomainListEntry
+		cursor.Decode(&entry)
+		entries = append(entries, entry)
+	}
+	return entries, cursor.Err()
+}
+
+// SetDomainListEntry puts entry.Domain on the entry.Kind list, taking it off the other one
+func SetDomainListEntry(ctx context.Context, client *mongo.Client, entry DomainListEntry) error {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("domain_lists")
+	_, err := collection.ReplaceOne(ctx, bson.M{"domain": entry.Domain}, entry, options.Replace().SetUpsert(true))
+	return err
+}
+
+func DeleteDomainListEntry(ctx context.Context, client *mongo.Client, kind string, domain string) error {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("domain_lists")
+	res, err := collection.DeleteOne(ctx, bson.M{"kind": kind, "domain": domain})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// domainOverrides maps domains to the custom list they are on
+type domainOverrides map[string]string
+
+// loadDomainOverrides loads both custom lists, for a worker run to check every domain against
+func loadDomainOverrides(ctx context.Context, client *mongo.Client) (domainOverrides, error) {
+	entries, err := GetDomainListEntries(ctx, client)
+	domainListsLoad.record(len(entries), err)
+	if err != nil {
+		return nil, err
+	}
+	overrides := make(domainOverrides, len(entries))
+	for _, entry := range entries {
+		overrides[entry.Domain] = entry.Kind
+	}
+	return overrides, nil
+}
+
+// how often the custom lists are reloaded between worker runs, for readyz to report on
+const domainListsReloadInterval = time.Minute
+
+// domainListsStatus is the outcome of the last load of the custom domain lists
+type domainListsStatus struct {
+	mu       sync.Mutex
+	loadedAt time.Time
+	domains  int
+	err      error
+}
+
+var domainListsLoad domainListsStatus
+
+func (s *domainListsStatus) record(domains int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+	if err == nil {
+		s.loadedAt = time.Now()
+		s.domains = domains
+	}
+}
+
+// status returns when the lists last loaded, how many domains they held and the error of the
+// last load. loadedAt is zero until the first load succeeded.
+func (s *domainListsStatus) status() (loadedAt time.Time, domains int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.loadedAt, s.domains, s.err
+}
+
+// loadDomainListsPeriodically fetches the verifier's upstream disposable domain list, so the
+// first verification doesn't wait for it, then reloads the custom lists until ctx is cancelled
+func loadDomainListsPeriodically(ctx context.Context, client *mongo.Client) {
+	sharedVerifier()
+	ticker := time.NewTicker(domainListsReloadInterval)
+	defer ticker.Stop()
+	for {
+		_, err := loadDomainOverrides(ctx, client)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("loading the custom domain lists", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// domainOverride returns the custom list domain is on, or "" when it is on neither
+func domainOverride(ctx context.Context, client *mongo.Client, domain string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("domain_lists")
+	var entry DomainListEntry
+	err := collection.FindOne(ctx, bson.M{"domain": strings.ToLower(domain)}).Decode(&entry)
+	if err == mongo.ErrNoDocuments {
+		return "", nil
+	}
+	return entry.Kind, err
+}
+
+// DomainClassification tells whether a domain is treated as disposable and which list decided it
+type DomainClassification struct {
+	Domain     string `json:"domain"`
+	Disposable bool   `json:"disposable"`
+	Source     string `json:"source"`
+	// the verdict of the verifier's own list, which the custom lists override
+	LibraryDisposable bool `json:"library_disposable"`
+}
+
+// classifyDomain works out the disposable verdict for domain given the custom list it is on.
+// The custom lists win over the verifier's list.
+func classifyDomain(verifier *emailVerifier.Verifier, domain string, override string) DomainClassification {
+	domain = strings.ToLower(domain)
+	classification := DomainClassification{Domain: domain, LibraryDisposable: verifier.IsDisposable(domain)}
+	switch {
+	case override == DomainListDisposable:
+		classification.Disposable, classification.Source = true, DomainSourceDisposable
+	case override == DomainListAllowlist:
+		classification.Disposable, classification.Source = false, DomainSourceAllowlist
+	case classification.LibraryDisposable:
+		classification.Disposable, classification.Source = true, DomainSourceLibrary
+	default:
+		classification.Source = DomainSourceNone
+	}
+	return classification
+}
+
+// ClassifyDomain returns the disposable verdict the worker would use for domain
+func ClassifyDomain(ctx context.Context, client *mongo.Client, domain string) (DomainClassification, error) {
+	override, err := domainOverride(ctx, client, domain)
+	if err != nil {
+		return DomainClassification{}, err
+	}
+	return classifyDomain(sharedVerifier(), domain, override), nil
+}
+
+// verifyWithOverride is verifier.Verify with the disposable verdict of the custom lists.
+// Addresses at custom disposable domains are not probed. The verifier skips the MX and SMTP
+// checks of domains on its own disposable list, so they are run here for allowlisted domains
+// on that list.
+func verifyWithOverride(verifier *emailVerifier.Verifier, email string, override string) (*emailVerifier.Result, error) {
+	syntax := verifier.ParseAddress(email)
+	if !syntax.Valid || override == "" {
+		return verifier.Verify(email)
+	}
+
+	ret := &emailVerifier.Result{
+		Email:       email,
+		Reachable:   reachableUnknown,
+		Syntax:      syntax,
+		Free:        verifier.IsFreeDomain(syntax.Domain),
+		RoleAccount: verifier.IsRoleAccount(syntax.Username),
+		Disposable:  classifyDomain(verifier, syntax.Domain, override).Disposable,
+	}
+	if ret.Disposable {
+		return ret, nil
+	}
+	// the verifier probes allowlisted domains it doesn't consider disposable itself
+	if !verifier.IsDisposable(syntax.Domain) {
+		return verifier.Verify(email)
+	}
+
+	mx, err := verifier.CheckMX(syntax.Domain)
+	if err != nil {
+		return ret, err
+	}
+	ret.HasMxRecords = mx.HasMXRecord
+
+	smtp, err := verifier.CheckSMTP(syntax.Domain, syntax.Username)
+	if err != nil {
+		return ret, err
+	}
+	ret.SMTP = smtp
+	// as the verifier works it out
+	switch {
+	case smtp == nil:
+	case smtp.Deliverable:
+		ret.Reachable = reachableYes
+	case !smtp.CatchAll:
+		ret.Reachable = reachableNo
+	}
+
+	// newVerifier enables the gravatar check and domain suggestions
+	gravatar, err := verifier.CheckGravatar(email)
+	if err != nil {
+		return ret, err
+	}
+	ret.Gravatar = gravatar
+	ret.Suggestion = verifier.SuggestDomain(syntax.Domain)
+	return ret, nil
+}
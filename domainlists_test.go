@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	emailVerifier "github.com/AfterShip/email-verifier"
+)
+
+func TestClassifyDomain(t *testing.T) {
+	verifier := emailVerifier.NewVerifier()
+	tests := []struct {
+		domain         string
+		override       string
+		wantDisposable bool
+		wantSource     string
+	}{
+		{"mailinator.com", "", true, DomainSourceLibrary},
+		{"Mailinator.com", DomainListAllowlist, false, DomainSourceAllowlist},
+		{"example.com", DomainListDisposable, true, DomainSourceDisposable},
+		{"example.com", "", false, DomainSourceNone},
+	}
+	for _, tt := range tests {
+		got := classifyDomain(verifier, tt.domain, tt.override)
+		if got.Disposable != tt.wantDisposable || got.Source != tt.wantSource {
+			t.Errorf("classifyDomain(%q, %q) = %+v, want disposable %v from %s", tt.domain, tt.override, got, tt.wantDisposable, tt.wantSource)
+		}
+	}
+}
+
+func TestVerifyWithOverrideAllowlistedLibraryDisposable(t *testing.T) {
+	verifier := emailVerifier.NewVerifier()
+	if !verifier.IsDisposable("mailinator.com") {
+		t.Fatal("the verifier no longer flags mailinator.com, pick another disposable domain")
+	}
+	// the verifier's own Verify stops at its disposable verdict without an MX lookup
+	ret, err := verifier.Verify("jane@mailinator.com")
+	if err != nil || ret.HasMxRecords {
+		t.Fatalf("Verify() looked up the MX of a disposable domain: %+v, %v", ret, err)
+	}
+
+	ret, err = verifyWithOverride(verifier, "jane@mailinator.com", DomainListAllowlist)
+	if ret == nil || ret.Disposable {
+		t.Fatalf("verifyWithOverride() = %+v, want a result that is not disposable", ret)
+	}
+	// the MX lookup ran: it either found the records or failed where there is no network
+	if err == nil && !ret.HasMxRecords {
+		t.Errorf("verifyWithOverride() skipped the MX check of an allowlisted domain: %+v", ret)
+	}
+}
+
+func TestVerifyWithOverrideCustomDisposable(t *testing.T) {
+	ret, err := verifyWithOverride(emailVerifier.NewVerifier(), "jane@example.com", DomainListDisposable)
+	if err != nil {
+		t.Fatalf("verifyWithOverride() returned %v", err)
+	}
+	if !ret.Disposable || ret.HasMxRecords || ret.Reachable != reachableUnknown || !ret.Syntax.Valid {
+		t.Errorf("verifyWithOverride() = %+v, want a disposable result that wasn't probed", ret)
+	}
+}
+
+func TestDomainListsStatus(t *testing.T) {
+	var s domainListsStatus
+	if loadedAt, _, err := s.status(); !loadedAt.IsZero() || err != nil {
+		t.Fatalf("status() before a load = %v, %v", loadedAt, err)
+	}
+	s.record(3, nil)
+	loadedAt, domains, err := s.status()
+	if loadedAt.IsZero() || domains != 3 || err != nil {
+		t.Fatalf("status() after a load = %v, %d, %v", loadedAt, domains, err)
+	}
+	// a failed reload keeps what was loaded last and reports the error
+	s.record(0, errors.New("timeout"))
+	if at, domains, err := s.status(); !at.Equal(loadedAt) || domains != 3 || err == nil {
+		t.Errorf("status() after a failed reload = %v, %d, %v", at, domains, err)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// error codes of the error body
+const (
+	CodeBadRequest          = "bad_request"
+	CodeInvalidID           = "invalid_id"
+	CodeInvalidJSON         = "invalid_json"
+	CodeValidationFailed    = "validation_failed"
+	CodeUnauthorized        = "unauthorized"
+	CodeForbidden           = "forbidden"
+	CodeNotFound            = "not_found"
+	CodeMethodNotAllowed    = "method_not_allowed"
+	CodeDuplicate           = "duplicate"
+	CodeInsufficientCredits = "insufficient_credits"
+	CodeTimeout             = "timeout"
+	CodeInternal            = "internal"
+)
+
+// APIError is an error with the status and code it is reported to the client with
+type APIError struct {
+	Status  int
+	Code    string
+	Message string
+	Details any
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+func badRequest(message string) *APIError {
+	return &APIError{Status: http.StatusBadRequest, Code: CodeBadRequest, Message: message}
+}
+
+func notFound(message string) *APIError {
+	return &APIError{Status: http.StatusNotFound, Code: CodeNotFound, Message: message}
+}
+
+func forbidden(message string) *APIError {
+	return &APIError{Status: http.StatusForbidden, Code: CodeForbidden, Message: message}
+}
+
+func unauthorized(message string) *APIError {
+	return &APIError{Status: http.StatusUnauthorized, Code: CodeUnauthorized, Message: message}
+}
+
+func conflict(message string) *APIError {
+	return &APIError{Status: http.StatusConflict, Code: CodeDuplicate, Message: message}
+}
+
+// invalidID reports an id in the path or body that is not an ObjectID
+func invalidID(field string) *APIError {
+	return &APIError{Status: http.StatusBadRequest, Code: CodeInvalidID, Message: field + " is not a valid id"}
+}
+
+// invalidJSON reports a request body that could not be decoded
+func invalidJSON(err error) *APIError {
+	message := "request body is not valid JSON: " + err.Error()
+	if errors.Is(err, io.EOF) {
+		message = "request body is empty"
+	}
+	return &APIError{Status: http.StatusBadRequest, Code: CodeInvalidJSON, Message: message}
+}
+
+// apiErrorFor maps err to the status and code it is reported with. Errors that are not
+// known to be caused by the request are internal and their message is not exposed.
+func apiErrorFor(err error) *APIError {
+	var apiErr *APIError
+	var invalidByte hex.InvalidByteError
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr
+	case errors.Is(err, mongo.ErrNoDocuments):
+		return notFound("not found")
+	case errors.Is(err, primitive.ErrInvalidHex), errors.As(err, &invalidByte):
+		return &APIError{Status: http.StatusBadRequest, Code: CodeInvalidID, Message: "invalid id"}
+	case errors.As(err, &syntaxErr), errors.As(err, &typeErr):
+		return invalidJSON(err)
+	case mongo.IsDuplicateKeyError(err):
+		return conflict("already exists")
+	case errors.Is(err, ErrInsufficientCredits):
+		return &APIError{Status: http.StatusPaymentRequired, Code: CodeInsufficientCredits, Message: err.Error()}
+	case errors.Is(err, context.DeadlineExceeded), mongo.IsTimeout(err):
+		return &APIError{Status: http.StatusGatewayTimeout, Code: CodeTimeout, Message: "the operation timed out"}
+	}
+	return &APIError{Status: http.StatusInternalServerError, Code: CodeInternal, Message: "internal server error"}
+}
+
+// verifyFailure is why a lead that was created could not be queued or verified
+type verifyFailure struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeError sends err as the JSON error body with the status it maps to
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	apiErr := apiErrorFor(err)
+	if apiErr.Status >= 500 {
+		loggerFromContext(r.Context()).Error("request failed", "path", r.URL.Path, "error", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(apiErr.Status)
+	json.NewEncoder(w).Encode(struct {
+		Code      string `json:"code"`
+		Message   string `json:"message"`
+		Details   any    `json:"details,omitempty"`
+		RequestID string `json:"request_id,omitempty"`
+	}{apiErr.Code, apiErr.Message, apiErr.Details, requestIDFromContext(r.Context())})
+}
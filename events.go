@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// list events live in a capped collection so every instance can tail it, the oldest
+	// events are dropped once it is full
+	listEventsCollectionSize = 64 << 20
+	// how long a tailing cursor waits for new events before the stream gets a keep-alive
+	listEventsAwaitTime = 2 * time.Second
+	// how long to wait before tailing again when the cursor died, e.g. on an empty collection
+	listEventsRetryInterval = time.Second
+)
+
+// ListProgress are the running totals of a list's verification. They are counted
+// when leads are queued and kept up to date by the worker as it verifies them.
+type ListProgress struct {
+	Total    int64 `bson:"total" json:"total"`
+	Verified int64 `bson:"verified" json:"verified"`
+	Valid    int64 `bson:"valid" json:"valid"`
+	Invalid  int64 `bson:"invalid" json:"invalid"`
+	Unknown  int64 `bson:"unknown" json:"unknown"`
+	// queue items of the list not verified yet
+	Queued int64 `bson:"queued" json:"queued"`
+}
+
+// ListEvent is published by the worker for every verified lead of a list
+type ListEvent struct {
+	ID                primitive.ObjectID `bson:"_id" json:"id"`
+	WorkspaceID       primitive.ObjectID `bson:"workspace_id" json:"-"`
+	ListID            primitive.ObjectID `bson:"list_id" json:"list_id"`
+	LeadID            primitive.ObjectID `bson:"lead_id" json:"lead_id"`
+	Email             string             `bson:"email" json:"email"`
+	EmailIsValid      string             `bson:"email_is_valid" json:"email_is_valid"`
+	VerificationError string             `bson:"verification_error,omitempty" json:"verification_error,omitempty"`
+	Progress          ListProgress       `bson:"progress" json:"progress"`
+	// set on the event of the list's last queued lead
+	Completed bool      `bson:"completed" json:"completed"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+}
+
+// progressField maps an email_is_valid value to its ListProgress counter
+func progressField(emailIsValid string) string {
+	switch emailIsValid {
+	case "yes":
+		return "progress.valid"
+	case "no":
+		return "progress.invalid"
+	case "unknown":
+		return "progress.unknown"
+	}
+	return ""
+}
+
+// startListProgress recounts the list's progress. It runs whenever leads are queued so
+// the totals don't drift when leads are changed outside of the worker.
+func startListProgress(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, listID primitive.ObjectID) error {
+	summary, err := GetListVerificationSummary(ctx, client, workspaceID, listID)
+	if err != nil {
+		return err
+	}
+	queueCollection := client.Database(config.Database).Collection("verification_queue")
+	queued, err := queueCollection.CountDocuments(ctx, bson.M{"list_id": listID, "workspace_id": workspaceID})
+	if err != nil {
+		return err
+	}
+	progress := ListProgress{
+		Total:    summary.Total,
+		Verified: summary.Verified,
+		Valid:    summary.Valid,
+		Invalid:  summary.Invalid,
+		Unknown:  summary.Unknown,
+		Queued:   queued,
+	}
+	collection := client.Database(config.Database).Collection("lists")
+	_, err = collection.UpdateOne(ctx, bson.M{"_id": listID, "workspace_id": workspaceID}, bson.M{"$set": bson.M{"progress": progress}})
+	return err
+}
+
+// EnsureListEventsCollection creates the capped collection list events are published to
+func EnsureListEventsCollection(ctx context.Context, client *mongo.Client) error {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	err := client.Database(config.Database).CreateCollection(ctx, "list_events", options.CreateCollection().SetCapped(true).SetSizeInBytes(listEventsCollectionSize))
+	var cmdErr mongo.CommandError
+	// NamespaceExists, the collection was created on an earlier start
+	if errors.As(err, &cmdErr) && cmdErr.Code == 48 {
+		return nil
+	}
+	return err
+}
+
+// publishListEvent makes event visible to the event streams of every instance
+func publishListEvent(ctx context.Context, client *mongo.Client, event ListEvent) error {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("list_events")
+	_, err := collection.InsertOne(ctx, event)
+	return err
+}
+
+// StreamListEvents calls send for every event of the list published after the event
+// with id after, and keepAlive whenever no event arrived for a while. It returns when ctx
+// is cancelled or either callback fails.
+func StreamListEvents(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, listID primitive.ObjectID, after primitive.ObjectID, send func(ListEvent) error, keepAlive func() error) error {
+	collection := client.Database(config.Database).Collection("list_events")
+	opts := options.Find().SetCursorType(options.TailableAwait).SetMaxAwaitTime(listEventsAwaitTime)
+	for {
+		cursor, err := collection.Find(ctx, bson.M{"workspace_id": workspaceID, "list_id": listID, "_id": bson.M{"$gt": after}}, opts)
+		if err != nil {
+			return err
+		}
+		for {
+			if cursor.TryNext(ctx) {
+				var event ListEvent
+				cursor.Decode(&event)
+				after = event.ID
+				err = send(event)
+				if err != nil {
+					cursor.Close(context.Background())
+					return err
+				}
+				continue
+			}
+			if cursor.Err() != nil || cursor.ID() == 0 {
+				break
+			}
+			err = keepAlive()
+			if err != nil {
+				cursor.Close(context.Background())
+				return err
+			}
+		}
+		cursor.Close(context.Background())
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// the cursor died, tail again from the last event sent
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(listEventsRetryInterval):
+		}
+		err = keepAlive()
+		if err != nil {
+			return err
+		}
+	}
+}
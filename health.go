@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// healthz answers as long as the process is able to serve requests
+func healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// readyz checks the dependencies the service needs to handle requests and answers 503
+// when one of them fails, or once shutdown has started so traffic is moved elsewhere
+func readyz(ctx context.Context, client *mongo.Client, worker *queueWorker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		checkCtx, cancel := context.WithTimeout(r.Context(), config.QueryTimeout)
+		defer cancel()
+
+		ready := true
+		checks := make(map[string]map[string]any)
+
+		start := time.Now()
+		err := client.Ping(checkCtx, readpref.Primary())
+		if err != nil {
+			ready = false
+			checks["mongodb"] = map[string]any{"status": "error", "error": err.Error()}
+		} else {
+			checks["mongodb"] = map[string]any{"status": "ok", "latency_ms": time.Since(start).Milliseconds()}
+		}
+
+		missing, err := MissingIndexes(checkCtx, client)
+		switch {
+		case err != nil:
+			ready = false
+			checks["indexes"] = map[string]any{"status": "error", "error": err.Error()}
+		case len(missing) > 0:
+			ready = false
+			checks["indexes"] = map[string]any{"status": "error", "missing": missing}
+		default:
+			checks["indexes"] = map[string]any{"status": "ok"}
+		}
+
+		// the verifier's upstream list is fetched before the custom lists are first loaded
+		loadedAt, domains, err := domainListsLoad.status()
+		switch {
+		case err != nil:
+			ready = false
+			checks["disposable_domains"] = map[string]any{"status": "error", "error": err.Error()}
+		case loadedAt.IsZero():
+			ready = false
+			checks["disposable_domains"] = map[string]any{"status": "error", "error": "not loaded yet"}
+		default:
+			checks["disposable_domains"] = map[string]any{"status": "ok", "custom_domains": domains, "loaded_at": loadedAt.UTC()}
+		}
+
+		// the worker only runs while there is work, so an idle worker is not a failure
+		running, inFlight := worker.status()
+		checks["worker"] = map[string]any{"status": "ok", "running": running, "in_flight": inFlight}
+
+		if ctx.Err() != nil {
+			ready = false
+			checks["shutdown"] = map[string]any{"status": "error", "error": "shutting down"}
+		}
+
+		status := "ready"
+		w.Header().Set("Content-Type", "application/json")
+		if !ready {
+			status = "not_ready"
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(struct {
+			Status string                    `json:"status"`
+			Checks map[string]map[string]any `json:"checks"`
+		}{status, checks})
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// the order the worker takes queue items in
+var queuePositionIndex = bson.D{{Key: "position", Value: 1}, {Key: "_id", Value: 1}}
+
+// collectionIndexes are the indexes the service relies on, per collection
+var collectionIndexes = []struct {
+	collection string
+	indexes    []mongo.IndexModel
+}{
+	{"verification_queue", []mongo.IndexModel{
+		// a lead can only be queued once
+		{Keys: bson.D{{Key: "lead_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "list_id", Value: 1}, {Key: "status", Value: 1}}},
+		{Keys: bson.D{{Key: "workspace_id", Value: 1}, {Key: "list_id", Value: 1}}},
+		{Keys: queuePositionIndex},
+	}},
+	{"rate_limits", []mongo.IndexModel{
+		{Keys: bson.D{{Key: "kind", Value: 1}, {Key: "host", Value: 1}}, Options: options.Index().SetUnique(true)},
+	}},
+	{"api_keys", []mongo.IndexModel{
+		{Keys: bson.D{{Key: "hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "workspace_id", Value: 1}}},
+	}},
+	{"workspaces", []mongo.IndexModel{
+		{Keys: bson.D{{Key: "name", Value: 1}}, Options: options.Index().SetUnique(true)},
+	}},
+	{"usage", []mongo.IndexModel{
+		{Keys: bson.D{{Key: "workspace_id", Value: 1}, {Key: "date", Value: 1}}, Options: options.Index().SetUnique(true)},
+	}},
+	{"webhooks", []mongo.IndexModel{
+		{Keys: bson.D{{Key: "workspace_id", Value: 1}, {Key: "events", Value: 1}}},
+	}},
+	{"webhook_deliveries", []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "next_attempt_at", Value: 1}}},
+		{Keys: bson.D{{Key: "webhook_id", Value: 1}, {Key: "_id", Value: -1}}},
+		// the open batch of a webhook that emitEvent adds to, there is one at most
+		{Keys: bson.D{{Key: "webhook_id", Value: 1}, {Key: "event", Value: 1}}, Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"batch_open": true})},
+		{Keys: bson.D{{Key: "finished_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(int32(webhookDeliveryRetention.Seconds()))},
+	}},
+	{"domain_lists", []mongo.IndexModel{
+		// a domain is on one list at most
+		{Keys: bson.D{{Key: "domain", Value: 1}}, Options: options.Index().SetUnique(true)},
+	}},
+	{"suppressions", []mongo.IndexModel{
+		{Keys: bson.D{{Key: "workspace_id", Value: 1}, {Key: "value", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "workspace_id", Value: 1}, {Key: "kind", Value: 1}}},
+	}},
+	{"lists", []mongo.IndexModel{
+		{Keys: bson.D{{Key: "workspace_id", Value: 1}}},
+	}},
+	{"leads", []mongo.IndexModel{
+		{Keys: bson.D{{Key: "list_id", Value: 1}, {Key: "email_verified", Value: 1}}},
+		{Keys: bson.D{{Key: "list_id", Value: 1}, {Key: "verified_at", Value: 1}}},
+		{Keys: bson.D{{Key: "verified_at", Value: 1}}},
+		{Keys: bson.D{{Key: "workspace_id", Value: 1}, {Key: "list_id", Value: 1}}},
+	}},
+}
+
+// EnsureIndexes creates the indexes the service relies on. It is safe to call on every start.
+func EnsureIndexes(ctx context.Context, client *mongo.Client) error {
+	ctx, cancel := context.WithTimeout(ctx, config.BulkTimeout)
+	defer cancel()
+
+	err := removeDuplicateQueueItems(ctx, client)
+	if err != nil {
+		return err
+	}
+	err = setMissingQueuePositions(ctx, client)
+	if err != nil {
+		return err
+	}
+	err = closeDuplicateOpenBatches(ctx, client)
+	if err != nil {
+		return err
+	}
+	err = setMissingDeliveryFinishTimes(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range collectionIndexes {
+		indexes := client.Database(config.Database).Collection(c.collection).Indexes()
+		for _, index := range c.indexes {
+			_, err = indexes.CreateOne(ctx, index)
+			var cmdErr mongo.CommandError
+			// IndexOptionsConflict, IndexKeySpecsConflict: an earlier version built the index
+			// with other options, such as the open batch index before it was unique
+			if errors.As(err, &cmdErr) && (cmdErr.Code == 85 || cmdErr.Code == 86) {
+				_, err = indexes.DropOne(ctx, indexName(index.Keys.(bson.D)))
+				if err == nil {
+					_, err = indexes.CreateOne(ctx, index)
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// indexName is the name MongoDB gives an index on keys by default, e.g. "list_id_1_status_1"
+func indexName(keys bson.D) string {
+	parts := make([]string, 0, 2*len(keys))
+	for _, key := range keys {
+		parts = append(parts, key.Key, fmt.Sprint(key.Value))
+	}
+	return strings.Join(parts, "_")
+}
+
+// MissingIndexes returns the indexes of collectionIndexes that don't exist, as "collection.index"
+func MissingIndexes(ctx context.Context, client *mongo.Client) ([]string, error) {
+	var missing []string
+	for _, c := range collectionIndexes {
+		cursor, err := client.Database(config.Database).Collection(c.collection).Indexes().List(ctx)
+		if err != nil {
+			return nil, err
+		}
+		existing := make(map[string]bool)
+		for cursor.Next(ctx) {
+			var index struct {
+				Name string `bson:"name"`
+			}
+			cursor.Decode(&index)
+			existing[index.Name] = true
+		}
+		cursor.Close(ctx)
+		if err := cursor.Err(); err != nil {
+			return nil, err
+		}
+		for _, index := range c.indexes {
+			name := indexName(index.Keys.(bson.D))
+			if !existing[name] {
+				missing = append(missing, c.collection+"."+name)
+			}
+		}
+	}
+	return missing, nil
+}
+
+// removeDuplicateQueueItems keeps the oldest queue item per lead so the unique
+// index on lead_id can be built on queues filled before it existed
+func removeDuplicateQueueItems(ctx context.Context, client *mongo.Client) error {
+	collection := client.Database(config.Database).Collection("verification_queue")
+	cursor, err := collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+		{{Key: "$group", Value: bson.M{"_id": "$lead_id", "ids": bson.M{"$push": "$_id"}, "count": bson.M{"$sum": 1}}}},
+		{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+	}, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	var duplicateIDs []interface{}
+	for cursor.Next(ctx) {
+		var group struct {
+			IDs []interface{} `bson:"ids"`
+		}
+		cursor.Decode(&group)
+		duplicateIDs = append(duplicateIDs, group.IDs[1:]...)
+	}
+	if len(duplicateIDs) == 0 {
+		return nil
+	}
+	_, err = collection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": duplicateIDs}})
+	return err
+}
+
+// closeDuplicateOpenBatches keeps the newest open batch per webhook and event open, so the
+// unique index on open batches can be built on deliveries written before it existed. The
+// batches closed are sent as they are.
+func closeDuplicateOpenBatches(ctx context.Context, client *mongo.Client) error {
+	collection := client.Database(config.Database).Collection("webhook_deliveries")
+	cursor, err := collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"batch_open": true}}},
+		{{Key: "$sort", Value: bson.M{"_id": -1}}},
+		{{Key: "$group", Value: bson.M{"_id": bson.M{"webhook_id": "$webhook_id", "event": "$event"}, "ids": bson.M{"$push": "$_id"}, "count": bson.M{"$sum": 1}}}},
+		{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+	})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	var duplicateIDs []interface{}
+	for cursor.Next(ctx) {
+		var group struct {
+			IDs []interface{} `bson:"ids"`
+		}
+		cursor.Decode(&group)
+		duplicateIDs = append(duplicateIDs, group.IDs[1:]...)
+	}
+	if len(duplicateIDs) == 0 {
+		return nil
+	}
+	_, err = collection.UpdateMany(ctx, bson.M{"_id": bson.M{"$in": duplicateIDs}}, bson.M{"$unset": bson.M{"batch_open": ""}})
+	return err
+}
+
+// setMissingDeliveryFinishTimes gives deliveries finished before finished_at existed one, so
+// they expire with the others
+func setMissingDeliveryFinishTimes(ctx context.Context, client *mongo.Client) error {
+	collection := client.Database(config.Database).Collection("webhook_deliveries")
+	_, err := collection.UpdateMany(ctx, bson.M{"status": bson.M{"$in": bson.A{DeliverySucceeded, DeliveryFailed}}, "finished_at": bson.M{"$exists": false}}, mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{"finished_at": bson.M{"$ifNull": bson.A{"$delivered_at", "$created_at"}}}}},
+	})
+	return err
+}
+
+// setMissingQueuePositions gives queue items filled before positions existed the position
+// queuePosition would have given them
+func setMissingQueuePositions(ctx context.Context, client *mongo.Client) error {
+	collection := client.Database(config.Database).Collection("verification_queue")
+	_, err := collection.UpdateMany(ctx, bson.M{"position": bson.M{"$exists": false}}, mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{"position": bson.M{"$subtract": bson.A{
+			bson.M{"$ifNull": bson.A{"$enqueued_at", "$$NOW"}},
+			bson.M{"$multiply": bson.A{bson.M{"$ifNull": bson.A{"$priority", 0}}, queuePriorityAging.Milliseconds()}},
+		}}}}},
+	})
+	return err
+}
@@ -4,101 +4,497 @@ import (
 	"context"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"strings"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-func CreateLead(client *mongo.Client, email string, listID primitive.ObjectID, leadData bson.M) (primitive.ObjectID, error) {
-	collection := client.Database("email_verify").Collection("leads")
-	res, err := collection.InsertOne(context.TODO(), bson.M{"email": email, "list_id": listID, "lead_data": leadData})
+func CreateLead(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, email string, listID primitive.ObjectID, leadData bson.M) (primitive.ObjectID, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("leads")
+	res, err := collection.InsertOne(ctx, bson.M{"email": email, "list_id": listID, "workspace_id": workspaceID, "lead_data": leadData})
 	if err != nil {
 		return primitive.NilObjectID, err
 	}
 	return res.InsertedID.(primitive.ObjectID), nil
 }
 
-func GetLead(client *mongo.Client, id primitive.ObjectID) (Lead, error) {
-	collection := client.Database("email_verify").Collection("leads")
+func GetLead(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, id primitive.ObjectID) (Lead, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("leads")
 	var lead Lead
-	err := collection.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&lead)
+	err := collection.FindOne(ctx, bson.M{"_id": id, "workspace_id": workspaceID, "deleted_at": bson.M{"$exists": false}}).Decode(&lead)
 	if err != nil {
 		return Lead{}, err
 	}
 	return lead, nil
 }
 
-func GetLeads(client *mongo.Client, listID primitive.ObjectID) ([]Lead, error) {
-	collection := client.Database("email_verify").Collection("leads")
-	cursor, err := collection.Find(context.TODO(), bson.M{"list_id": listID})
+func GetLeads(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, listID primitive.ObjectID) ([]Lead, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.BulkTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("leads")
+	cursor, err := collection.Find(ctx, bson.M{"list_id": listID, "workspace_id": workspaceID, "deleted_at": bson.M{"$exists": false}})
 	if err != nil {
 		return nil, err
 	}
-	defer cursor.Close(context.TODO())
+	defer cursor.Close(ctx)
 
 	var leads []Lead
-	for cursor.Next(context.Background()) {
+	for cursor.Next(ctx) {
 		var lead Lead
 		cursor.Decode(&lead)
 		leads = append(leads, lead)
 	}
-	return leads, nil
+	return leads, cursor.Err()
 }
 
-func GetLeadsCount(client *mongo.Client, listID primitive.ObjectID) (int64, error) {
-	collection := client.Database("email_verify").Collection("leads")
-	return collection.CountDocuments(context.TODO(), bson.M{"list_id": listID})
+func GetLeadsCount(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, listID primitive.ObjectID) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("leads")
+	return collection.CountDocuments(ctx, bson.M{"list_id": listID, "workspace_id": workspaceID, "deleted_at": bson.M{"$exists": false}})
+}
+
+// ListVerificationSummary counts the leads of a list by verification outcome
+type ListVerificationSummary struct {
+	ListID   primitive.ObjectID `json:"list_id"`
+	Total    int64              `json:"total"`
+	Verified int64              `json:"verified"`
+	Valid    int64              `json:"valid"`
+	Invalid  int64              `json:"invalid"`
+	Unknown  int64              `json:"unknown"`
+}
+
+// GetListVerificationSummary counts the leads of the list by outcome in a single query
+func GetListVerificationSummary(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, listID primitive.ObjectID) (ListVerificationSummary, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	summary := ListVerificationSummary{ListID: listID}
+	collection := client.Database(config.Database).Collection("leads")
+	cursor, err := collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"list_id": listID, "workspace_id": workspaceID, "deleted_at": bson.M{"$exists": false}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":      "$email_is_valid",
+			"count":    bson.M{"$sum": 1},
+			"verified": bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$email_verified", true}}, 1, 0}}},
+		}}},
+	})
+	if err != nil {
+		return summary, err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var group struct {
+			EmailIsValid any   `bson:"_id"`
+			Count        int64 `bson:"count"`
+			Verified     int64 `bson:"verified"`
+		}
+		cursor.Decode(&group)
+		summary.Total += group.Count
+		summary.Verified += group.Verified
+		switch group.EmailIsValid {
+		case "yes":
+			summary.Valid += group.Count
+		case "no":
+			summary.Invalid += group.Count
+		case "unknown":
+			summary.Unknown += group.Count
+		}
+	}
+	return summary, cursor.Err()
 }
 
-func CountEmailVerified(client *mongo.Client, listID primitive.ObjectID) (int64, error) {
-	collection := client.Database("email_verify").Collection("leads")
-	return collection.CountDocuments(context.TODO(), bson.M{"list_id": listID, "email_verified": true})
+func CountEmailVerified(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, listID primitive.ObjectID) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("leads")
+	return collection.CountDocuments(ctx, bson.M{"list_id": listID, "workspace_id": workspaceID, "deleted_at": bson.M{"$exists": false}, "email_verified": true})
 }
 
-func CountValidEmails(client *mongo.Client, listID primitive.ObjectID) (int64, error) {
-	collection := client.Database("email_verify").Collection("leads")
-	return collection.CountDocuments(context.TODO(), bson.M{"list_id": listID, "email_is_valid": "yes"})
+func CountValidEmails(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, listID primitive.ObjectID) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("leads")
+	return collection.CountDocuments(ctx, bson.M{"list_id": listID, "workspace_id": workspaceID, "deleted_at": bson.M{"$exists": false}, "email_is_valid": "yes"})
 }
 
-func CountInvalidEmails(client *mongo.Client, listID primitive.ObjectID) (int64, error) {
-	collection := client.Database("email_verify").Collection("leads")
-	return collection.CountDocuments(context.TODO(), bson.M{"list_id": listID, "email_is_valid": "no"})
+func CountInvalidEmails(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, listID primitive.ObjectID) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("leads")
+	return collection.CountDocuments(ctx, bson.M{"list_id": listID, "workspace_id": workspaceID, "deleted_at": bson.M{"$exists": false}, "email_is_valid": "no"})
 }
 
-func CountUnknownEmails(client *mongo.Client, listID primitive.ObjectID) (int64, error) {
-	collection := client.Database("email_verify").Collection("leads")
-	return collection.CountDocuments(context.TODO(), bson.M{"list_id": listID, "email_is_valid": "unknown"})
+func CountUnknownEmails(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, listID primitive.ObjectID) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("leads")
+	return collection.CountDocuments(ctx, bson.M{"list_id": listID, "workspace_id": workspaceID, "deleted_at": bson.M{"$exists": false}, "email_is_valid": "unknown"})
 }
 
 // count for all emails no matter the list
 
-func CountAllEmails(client *mongo.Client, emailIsValid string) (int64, error) {
+func CountAllEmails(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, emailIsValid string) (int64, error) {
 	// emailIsValid can be "yes", "no", or "unknown" or empty string to count all emails
-	collection := client.Database("email_verify").Collection("leads")
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("leads")
 	if emailIsValid == "" {
-		return collection.CountDocuments(context.TODO(), bson.M{})
+		return collection.CountDocuments(ctx, bson.M{"workspace_id": workspaceID, "deleted_at": bson.M{"$exists": false}})
+	} else {
+		return collection.CountDocuments(ctx, bson.M{"workspace_id": workspaceID, "deleted_at": bson.M{"$exists": false}, "email_is_valid": emailIsValid})
+	}
+}
+
+// UpdateLead changes the lead's email when email is set and merges leadData into
+// the existing lead data, a nil value removes that key. A changed email resets the
+// verification state and drops the lead's queue items since the previous result and
+// the queued address no longer apply.
+func UpdateLead(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, id primitive.ObjectID, email *string, leadData map[string]interface{}) (Lead, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	lead, err := GetLead(ctx, client, workspaceID, id)
+	if err != nil {
+		return Lead{}, false, err
+	}
+
+	set := bson.M{}
+	unset := bson.M{}
+	emailChanged := email != nil && *email != lead.Email
+	if emailChanged {
+		set["email"] = *email
+		// the old address's verification, error and suppression don't apply to the new one
+		for _, field := range []string{"email_verified", "email_is_valid", "verification_result", "verified_at", "verification_error", "suppressed"} {
+			unset[field] = ""
+		}
+	}
+	err = mergeDocumentFields("lead_data", leadData, set, unset)
+	if err != nil {
+		return Lead{}, false, err
+	}
+
+	update := bson.M{}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	if len(update) == 0 {
+		return lead, false, nil
+	}
+
+	collection := client.Database(config.Database).Collection("leads")
+	_, err = collection.UpdateOne(ctx, bson.M{"_id": id, "workspace_id": workspaceID}, update)
+	if err != nil {
+		return Lead{}, false, err
+	}
+	if emailChanged {
+		// an item still in flight is dropped too, Dequeue then finds it gone and keeps its result off the lead
+		_, err = dequeueLeads(ctx, client, workspaceID, lead.ListID, []primitive.ObjectID{id})
+		if err != nil {
+			return Lead{}, false, err
+		}
+		if lead.EmailVerified {
+			inc := bson.M{"progress.verified": -1}
+			if field := progressField(lead.EmailIsValid); field != "" {
+				inc[field] = -1
+			}
+			listsCollection := client.Database(config.Database).Collection("lists")
+			_, err = listsCollection.UpdateOne(ctx,
+				bson.M{"_id": lead.ListID, "workspace_id": workspaceID, "progress": bson.M{"$exists": true}},
+				bson.M{"$inc": inc})
+			if err != nil {
+				return Lead{}, false, err
+			}
+		}
+	}
+	lead, err = GetLead(ctx, client, workspaceID, id)
+	return lead, emailChanged, err
+}
+
+// verificationUpdate is the update storing a verification result on a lead
+func verificationUpdate(emailIsValid string, verificationResult bson.M, verificationError string) bson.M {
+	update := bson.M{"$set": bson.M{"email_is_valid": emailIsValid, "verification_result": verificationResult, "email_verified": true, "verified_at": time.Now()}}
+	if verificationError != "" {
+		update["$set"].(bson.M)["verification_error"] = verificationError
 	} else {
-		return collection.CountDocuments(context.TODO(), bson.M{"email_is_valid": emailIsValid})
+		update["$unset"] = bson.M{"verification_error": ""}
+	}
+	return update
+}
+
+// SetLeadVerification stores the result of a verification made outside the queue on the
+// lead, counts it in the workspace's usage and returns the updated lead. The caller has
+// reserved the credit for it.
+func SetLeadVerification(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, id primitive.ObjectID, emailIsValid string, verificationResult bson.M, verificationError string) (Lead, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("leads")
+	var lead Lead
+	err := collection.FindOneAndUpdate(ctx, bson.M{"_id": id, "workspace_id": workspaceID},
+		verificationUpdate(emailIsValid, verificationResult, verificationError),
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&lead)
+	if err != nil {
+		return Lead{}, err
+	}
+	// the credit was reserved before the probe, which counts even when it failed
+	err = countVerification(ctx, client, workspaceID)
+	if err != nil {
+		return Lead{}, err
+	}
+	return lead, nil
+}
+
+// DeleteLead removes the lead and any queue entries pointing at it
+func DeleteLead(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, id primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	_, err := deleteQueueItems(ctx, client, workspaceID, bson.M{"lead_id": id})
+	if err != nil {
+		return err
+	}
+
+	collection := client.Database(config.Database).Collection("leads")
+	res, err := collection.DeleteOne(ctx, bson.M{"_id": id, "workspace_id": workspaceID})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// leadSelector builds the query for the leads of listID picked either by ID or by filter
+func leadSelector(workspaceID primitive.ObjectID, listID primitive.ObjectID, leadIDs []primitive.ObjectID, filter *LeadFilter) bson.M {
+	selector := bson.M{"list_id": listID, "workspace_id": workspaceID, "deleted_at": bson.M{"$exists": false}}
+	if len(leadIDs) > 0 {
+		selector["_id"] = bson.M{"$in": leadIDs}
+	}
+	if filter != nil {
+		if filter.EmailVerified != nil {
+			// leads that were never verified, or whose email changed, have no email_verified
+			selector["email_verified"] = *filter.EmailVerified
+			if !*filter.EmailVerified {
+				selector["email_verified"] = bson.M{"$ne": true}
+			}
+		}
+		if filter.EmailIsValid != nil {
+			selector["email_is_valid"] = *filter.EmailIsValid
+		}
+	}
+	return selector
+}
+
+// MoveLeads moves the selected leads to another list, their pending queue items go with them
+func MoveLeads(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, selector bson.M, targetListID primitive.ObjectID) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.BulkTimeout)
+	defer cancel()
+
+	// never let a selector reach into another workspace
+	selector["workspace_id"] = workspaceID
+	collection := client.Database(config.Database).Collection("leads")
+	cursor, err := collection.Find(ctx, selector)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var leadIDs []primitive.ObjectID
+	for cursor.Next(ctx) {
+		var lead Lead
+		cursor.Decode(&lead)
+		leadIDs = append(leadIDs, lead.ID)
+	}
+	if len(leadIDs) == 0 {
+		return 0, nil
+	}
+
+	res, err := collection.UpdateMany(ctx, bson.M{"_id": bson.M{"$in": leadIDs}, "workspace_id": workspaceID}, bson.M{"$set": bson.M{"list_id": targetListID}})
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = moveQueueItems(ctx, client, workspaceID, leadIDs, targetListID)
+	return res.ModifiedCount, err
+}
+
+// CopyLeads copies the selected leads, including their verification results, into another list
+func CopyLeads(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, selector bson.M, targetListID primitive.ObjectID) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.BulkTimeout)
+	defer cancel()
+
+	// never let a selector reach into another workspace
+	selector["workspace_id"] = workspaceID
+	collection := client.Database(config.Database).Collection("leads")
+	cursor, err := collection.Find(ctx, selector)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var leads []interface{}
+	for cursor.Next(ctx) {
+		var lead Lead
+		cursor.Decode(&lead)
+		lead.ID = primitive.NewObjectID()
+		lead.ListID = targetListID
+		leads = append(leads, lead)
+	}
+	if len(leads) == 0 {
+		return 0, nil
+	}
+
+	res, err := collection.InsertMany(ctx, leads)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(res.InsertedIDs)), nil
+}
+
+// maximum number of leads a bulk creation accepts
+const maxBulkLeads = 1000
+
+// CreateLeads inserts leads into the list, setting their IDs. It returns the insert
+// error of each lead, nil for the leads that were created; a lead that fails doesn't
+// keep the others from being inserted.
+func CreateLeads(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, listID primitive.ObjectID, leads []Lead) ([]error, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.BulkTimeout)
+	defer cancel()
+
+	// the list must belong to the caller's workspace
+	_, err := GetList(ctx, client, workspaceID, listID)
+	if err != nil {
+		return nil, err
+	}
+
+	insertErrs := make([]error, len(leads))
+	if len(leads) == 0 {
+		return insertErrs, nil
+	}
+	docs := make([]interface{}, len(leads))
+	for i := range leads {
+		leads[i].ID = primitive.NewObjectID()
+		leads[i].WorkspaceID = workspaceID
+		leads[i].ListID = listID
+		docs[i] = leads[i]
+	}
+	collection := client.Database(config.Database).Collection("leads")
+	_, err = collection.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) && bulkErr.WriteConcernError == nil {
+		for _, writeErr := range bulkErr.WriteErrors {
+			insertErrs[writeErr.Index] = writeErr
+		}
+		return insertErrs, nil
+	}
+	return insertErrs, err
+}
+
+// DeleteLeads removes the selected leads of the list along with their queue items and
+// returns how many leads and queue items were removed
+func DeleteLeads(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, listID primitive.ObjectID, selector bson.M) (int64, int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.BulkTimeout)
+	defer cancel()
+
+	// never let a selector reach into another workspace
+	selector["workspace_id"] = workspaceID
+	collection := client.Database(config.Database).Collection("leads")
+	cursor, err := collection.Find(ctx, selector, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var leadIDs []primitive.ObjectID
+	for cursor.Next(ctx) {
+		var lead Lead
+		cursor.Decode(&lead)
+		leadIDs = append(leadIDs, lead.ID)
+	}
+	if err := cursor.Err(); err != nil {
+		return 0, 0, err
+	}
+	if len(leadIDs) == 0 {
+		return 0, 0, nil
+	}
+
+	// the queue items go first so the worker never picks up an item without its lead
+	dequeued, err := dequeueLeads(ctx, client, workspaceID, listID, leadIDs)
+	if err != nil {
+		return 0, 0, err
 	}
+
+	res, err := collection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": leadIDs}, "workspace_id": workspaceID})
+	if err != nil {
+		return 0, 0, err
+	}
+	return res.DeletedCount, dequeued, nil
 }
 
-func DeleteLead(client *mongo.Client, id primitive.ObjectID) error {
-	collection := client.Database("email_verify").Collection("leads")
-	_, err := collection.DeleteOne(context.TODO(), bson.M{"_id": id})
-	return err
+// dequeueLeads removes the queue items of the leads of listID, keeping the list's
+// progress in step, and returns how many were removed
+func dequeueLeads(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, listID primitive.ObjectID, leadIDs []primitive.ObjectID) (int64, error) {
+	removed, err := deleteQueueItems(ctx, client, workspaceID, bson.M{"lead_id": bson.M{"$in": leadIDs}})
+	if err != nil {
+		return 0, err
+	}
+	if removed > 0 {
+		listsCollection := client.Database(config.Database).Collection("lists")
+		_, err = listsCollection.UpdateOne(ctx,
+			bson.M{"_id": listID, "workspace_id": workspaceID, "progress": bson.M{"$exists": true}},
+			bson.M{"$inc": bson.M{"progress.queued": -removed}})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return removed, nil
 }
 
-func AddLeadsFromCSV(client *mongo.Client, listID primitive.ObjectID, request *http.Request) error {
-	collection := client.Database("email_verify").Collection("leads")
+// AddLeadsFromCSV adds a lead per row of the uploaded csv file to the list and returns how many were added
+func AddLeadsFromCSV(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, listID primitive.ObjectID, request *http.Request) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.ImportTimeout)
+	defer cancel()
+
+	// the list must belong to the caller's workspace
+	_, err := GetList(ctx, client, workspaceID, listID)
+	if err != nil {
+		return 0, err
+	}
+
+	collection := client.Database(config.Database).Collection("leads")
 
 	// Read csv from request
 	file, _, err := request.FormFile("csvfile")
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer file.Close()
 
@@ -107,7 +503,7 @@ func AddLeadsFromCSV(client *mongo.Client, listID primitive.ObjectID, request *h
 	// find email index in csv
 	header, err := csvReader.Read()
 	if err != nil {
-		return err
+		return 0, err
 	}
 	emailIdx := -1
 	for i, h := range header {
@@ -120,12 +516,16 @@ func AddLeadsFromCSV(client *mongo.Client, listID primitive.ObjectID, request *h
 
 	var leads []interface{}
 	for {
+		// stop reading when the client went away or the import deadline passed
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
 		record, err := csvReader.Read()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return err
+			return 0, err
 		}
 
 		// Get email from csv
@@ -144,10 +544,11 @@ func AddLeadsFromCSV(client *mongo.Client, listID primitive.ObjectID, request *h
 
 		// Create Lead object
 		lead := Lead{
-			ID:       primitive.NewObjectID(),
-			Email:    email,
-			ListID:   listID,
-			LeadData: leadData,
+			ID:          primitive.NewObjectID(),
+			WorkspaceID: workspaceID,
+			Email:       email,
+			ListID:      listID,
+			LeadData:    leadData,
 		}
 
 		// Add lead to leads array
@@ -155,18 +556,51 @@ func AddLeadsFromCSV(client *mongo.Client, listID primitive.ObjectID, request *h
 	}
 
 	// Insert leads into database
-	_, err = collection.InsertMany(context.TODO(), leads)
-
-	return err
+	_, err = collection.InsertMany(ctx, leads)
+	if err != nil {
+		return 0, err
+	}
+	csvImportRows.Add(float64(len(leads)))
+	return len(leads), nil
 }
 
-func DownloadLeadsAsCSV(client *mongo.Client, listID primitive.ObjectID, w http.ResponseWriter) error {
-	collection := client.Database("email_verify").Collection("leads")
-	cursor, err := collection.Find(context.TODO(), bson.M{"list_id": listID})
+// DownloadLeadsAsCSV writes the leads of the list to w as csv. Leads matching the
+// suppression list are left out unless includeSuppressed is set.
+func DownloadLeadsAsCSV(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, listID primitive.ObjectID, includeSuppressed bool, w http.ResponseWriter) error {
+	ctx, cancel := context.WithTimeout(ctx, config.ExportTimeout)
+	defer cancel()
+
+	suppressions, err := loadSuppressions(ctx, client, workspaceID)
 	if err != nil {
 		return err
 	}
-	defer cursor.Close(context.TODO())
+
+	collection := client.Database(config.Database).Collection("leads")
+	// the header holds every lead data key of the list, so a first pass collects them
+	filter := bson.M{"list_id": listID, "workspace_id": workspaceID, "deleted_at": bson.M{"$exists": false}}
+	cursor, err := collection.Find(ctx, filter, options.Find().SetProjection(bson.M{"email": 1, "lead_data": 1}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	var header csvHeader
+	for cursor.Next(ctx) {
+		var lead Lead
+		cursor.Decode(&lead)
+		if !includeSuppressed && suppressions.matches(lead.Email) {
+			continue
+		}
+		header.add(lead.LeadData)
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	cursor.Close(ctx)
+	cursor, err = collection.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
 
 	w.Header().Set("Content-Type", "text/csv")
 	w.Header().Set("Content-Disposition", "attachment; filename=leads.csv")
@@ -174,83 +608,98 @@ func DownloadLeadsAsCSV(client *mongo.Client, listID primitive.ObjectID, w http.
 	writer := csv.NewWriter(w)
 	defer writer.Flush()
 
-	// write header from first lead
-
-	if cursor.Next(context.Background()) {
+	err = writer.Write(header.columns())
+	if err != nil {
+		return err
+	}
+	for cursor.Next(ctx) {
 		var lead Lead
 		cursor.Decode(&lead)
-		// lead.LeadData is a primitive.D
-		// convert it to map[string]interface{}
-		leadData, err := json.Marshal(lead.LeadData)
-		if err != nil {
-			return err
-		}
-		// define and array leadDataKeys to store keys of leadData sample leadDataKeys = [{}]
-		var leadDataKeys []struct {
-			Key   string
-			Value string
-		}
-		// unmarshal leadData to leadDataKeys
-		err = json.Unmarshal(leadData, &leadDataKeys)
-		if err != nil {
-			return err
-		}
-		// write header to csv
-		var header []string
-		header = append(header, "email")
-		for _, key := range leadDataKeys {
-			header = append(header, key.Key)
+		if !includeSuppressed && suppressions.matches(lead.Email) {
+			continue
 		}
-		header = append(header, "email_is_valid")
-		header = append(header, "verification_result")
-		err = writer.Write(header)
+		record, err := header.record(lead)
 		if err != nil {
 			return err
 		}
-		cursor.Close(context.Background())
-		cursor, err = collection.Find(context.TODO(), bson.M{"list_id": listID})
+		err = writer.Write(record)
 		if err != nil {
 			return err
 		}
-		defer cursor.Close(context.TODO())
 	}
 
-	for cursor.Next(context.Background()) {
-		var lead Lead
-		cursor.Decode(&lead)
-		// lead.LeadData is a primitive.D
-		// convert it to map[string]interface{}
-		leadData, err := json.Marshal(lead.LeadData)
-		if err != nil {
-			return err
-		}
-		// define and array leadDataKeys to store keys of leadData sample leadDataKeys = [{}]
-		var leadDataKeys []struct {
-			Key   string
-			Value string
+	// the cursor stops early when the client disconnects or the export deadline passes
+	return cursor.Err()
+}
+
+// csvHeader holds the lead data keys of an export in the order they first appear
+type csvHeader struct {
+	keys  []string
+	index map[string]bool
+}
+
+// add appends the keys of a lead's lead_data that aren't in the header yet
+func (h *csvHeader) add(leadData any) {
+	if h.index == nil {
+		h.index = make(map[string]bool)
+	}
+	for _, e := range toDocument(leadData) {
+		if !h.index[e.Key] {
+			h.index[e.Key] = true
+			h.keys = append(h.keys, e.Key)
 		}
-		// unmarshal leadData to leadDataKeys
-		err = json.Unmarshal(leadData, &leadDataKeys)
+	}
+}
+
+func (h *csvHeader) columns() []string {
+	columns := append([]string{"email"}, h.keys...)
+	return append(columns, "email_is_valid", "verification_result")
+}
+
+// record returns the row of a lead in header order, leaving keys the lead doesn't have empty
+func (h *csvHeader) record(lead Lead) ([]string, error) {
+	values := make(map[string]any)
+	for _, e := range toDocument(lead.LeadData) {
+		values[e.Key] = e.Value
+	}
+	record := []string{lead.Email}
+	for _, key := range h.keys {
+		value, err := csvValue(values[key])
 		if err != nil {
-			return err
-		}
-		// write lead to csv
-		var record []string
-		record = append(record, lead.Email)
-		for _, key := range leadDataKeys {
-			record = append(record, key.Value)
+			return nil, err
 		}
-		record = append(record, lead.EmailIsValid)
-		verificationResult, err := json.Marshal(lead.VerificationResult)
+		record = append(record, value)
+	}
+	verificationResult, err := csvValue(lead.VerificationResult)
+	if err != nil {
+		return nil, err
+	}
+	return append(record, lead.EmailIsValid, verificationResult), nil
+}
+
+// csvValue formats a lead_data value for a csv cell. Strings are written as is, numbers
+// and booleans as Go formats them and documents and arrays as JSON.
+func csvValue(value any) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case primitive.DateTime:
+		return v.Time().UTC().Format(time.RFC3339), nil
+	case primitive.ObjectID:
+		return v.Hex(), nil
+	case primitive.D, primitive.M, primitive.A, map[string]any, []any:
+		// extended JSON keeps the key order of documents, a wrapper lets arrays through
+		data, err := bson.MarshalExtJSON(bson.D{{Key: "v", Value: v}}, false, false)
 		if err != nil {
-			return err
+			return "", err
 		}
-		record = append(record, string(verificationResult))
-		err = writer.Write(record)
-		if err != nil {
-			return err
+		var wrapper struct {
+			V json.RawMessage `json:"v"`
 		}
+		err = json.Unmarshal(data, &wrapper)
+		return string(wrapper.V), err
 	}
-
-	return nil
+	return fmt.Sprint(value), nil
 }
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCSVHeaderMixedValues(t *testing.T) {
+	verifiedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	leads := []Lead{
+		{Email: "a@example.com", LeadData: primitive.D{{Key: "name", Value: "Ann"}, {Key: "age", Value: int32(30)}}},
+		{
+			Email: "b@example.com",
+			LeadData: primitive.D{
+				{Key: "vip", Value: true},
+				{Key: "age", Value: 41.5},
+				{Key: "address", Value: primitive.D{{Key: "city", Value: "Oslo"}, {Key: "zip", Value: "0150"}}},
+				{Key: "tags", Value: primitive.A{"a", int64(2)}},
+				{Key: "signed_up", Value: primitive.NewDateTimeFromTime(verifiedAt)},
+				{Key: "note", Value: nil},
+			},
+			EmailIsValid:       "true",
+			VerificationResult: primitive.D{{Key: "reachable", Value: "yes"}},
+		},
+		{Email: "c@example.com"},
+	}
+
+	var header csvHeader
+	for _, lead := range leads {
+		header.add(lead.LeadData)
+	}
+	wantColumns := []string{"email", "name", "age", "vip", "address", "tags", "signed_up", "note", "email_is_valid", "verification_result"}
+	if got := header.columns(); !slices.Equal(got, wantColumns) {
+		t.Fatalf("columns() = %q, want %q", got, wantColumns)
+	}
+
+	want := [][]string{
+		{"a@example.com", "Ann", "30", "", "", "", "", "", "", ""},
+		{"b@example.com", "", "41.5", "true", `{"city":"Oslo","zip":"0150"}`, `["a",2]`, "2024-05-01T12:00:00Z", "", "true", `{"reachable":"yes"}`},
+		{"c@example.com", "", "", "", "", "", "", "", "", ""},
+	}
+	for i, lead := range leads {
+		got, err := header.record(lead)
+		if err != nil {
+			t.Fatalf("record(%s) returned %v", lead.Email, err)
+		}
+		if !slices.Equal(got, want[i]) {
+			t.Errorf("record(%s) = %q, want %q", lead.Email, got, want[i])
+		}
+	}
+}
@@ -2,50 +2,548 @@ package main
 
 import (
 	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-func CreateList(client *mongo.Client, name string) (primitive.ObjectID, error) {
-	collection := client.Database("email_verify").Collection("lists")
-	res, err := collection.InsertOne(context.TODO(), bson.M{"name": name})
+// how often the trash is checked for lists past their retention period
+const listTrashPurgeInterval = time.Hour
+
+func CreateList(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, name string) (primitive.ObjectID, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("lists")
+	res, err := collection.InsertOne(ctx, bson.M{"name": name, "workspace_id": workspaceID})
 	if err != nil {
 		return primitive.NilObjectID, err
 	}
 	return res.InsertedID.(primitive.ObjectID), nil
 }
 
-func GetList(client *mongo.Client, id primitive.ObjectID) (List, error) {
-	collection := client.Database("email_verify").Collection("lists")
+// GetList returns the list unless it is in the trash, see GetTrashedList for those
+func GetList(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, id primitive.ObjectID) (List, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("lists")
 	var list List
-	err := collection.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&list)
+	err := collection.FindOne(ctx, bson.M{"_id": id, "workspace_id": workspaceID, "deleted_at": bson.M{"$exists": false}}).Decode(&list)
 	if err != nil {
 		return List{}, err
 	}
 	return list, nil
 }
 
-func GetLists(client *mongo.Client) ([]List, error) {
-	collection := client.Database("email_verify").Collection("lists")
-	cursor, err := collection.Find(context.TODO(), bson.M{})
+// GetTrashedList returns the list only when it is in the trash
+func GetTrashedList(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, id primitive.ObjectID) (List, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("lists")
+	var list List
+	err := collection.FindOne(ctx, bson.M{"_id": id, "workspace_id": workspaceID, "deleted_at": bson.M{"$exists": true}}).Decode(&list)
+	if err != nil {
+		return List{}, err
+	}
+	return list, nil
+}
+
+func GetLists(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID) ([]List, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("lists")
+	cursor, err := collection.Find(ctx, bson.M{"workspace_id": workspaceID, "deleted_at": bson.M{"$exists": false}})
 	if err != nil {
 		return nil, err
 	}
-	defer cursor.Close(context.TODO())
+	defer cursor.Close(ctx)
 
 	var lists []List
-	for cursor.Next(context.Background()) {
+	for cursor.Next(ctx) {
 		var list List
 		cursor.Decode(&list)
 		lists = append(lists, list)
 	}
-	return lists, nil
+	return lists, cursor.Err()
+}
+
+// UpdateList renames the list and changes its queue priority when those are set,
+// and merges metadata into the list's existing metadata. A nil value in metadata
+// removes that key.
+func UpdateList(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, id primitive.ObjectID, name *string, queuePriority *int, metadata map[string]interface{}) (List, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	set := bson.M{}
+	unset := bson.M{}
+	if name != nil {
+		set["name"] = *name
+	}
+	if queuePriority != nil {
+		set["queue_priority"] = *queuePriority
+	}
+	err := mergeDocumentFields("metadata", metadata, set, unset)
+	if err != nil {
+		return List{}, err
+	}
+
+	update := bson.M{}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	if len(update) == 0 {
+		return GetList(ctx, client, workspaceID, id)
+	}
+
+	collection := client.Database(config.Database).Collection("lists")
+	res, err := collection.UpdateOne(ctx, bson.M{"_id": id, "workspace_id": workspaceID, "deleted_at": bson.M{"$exists": false}}, update)
+	if err != nil {
+		return List{}, err
+	}
+	if res.MatchedCount == 0 {
+		return List{}, mongo.ErrNoDocuments
+	}
+	return GetList(ctx, client, workspaceID, id)
+}
+
+// validDocumentKey reports whether key can be stored as a field of lead data or metadata
+func validDocumentKey(key string) bool {
+	return key != "" && !strings.Contains(key, ".") && !strings.HasPrefix(key, "$")
+}
+
+// mergeDocumentFields turns a partial document into dotted $set/$unset entries
+// under field so that keys not mentioned in values are left untouched
+func mergeDocumentFields(field string, values map[string]interface{}, set bson.M, unset bson.M) error {
+	for key, value := range values {
+		if !validDocumentKey(key) {
+			return badRequest("invalid " + field + " key: " + key)
+		}
+		if value == nil {
+			unset[field+"."+key] = ""
+		} else {
+			set[field+"."+key] = value
+		}
+	}
+	return nil
+}
+
+// strategies for resolving lead_data keys present on both sides of a merge
+const (
+	MergeKeepTarget = "keep_target"
+	MergeKeepSource = "keep_source"
+)
+
+// MergeResult reports what happened to the source leads during MergeLists
+type MergeResult struct {
+	Moved  int `json:"moved"`
+	Merged int `json:"merged"`
+}
+
+// how many source leads MergeLists handles per round of writes
+const mergeBatchSize = 500
+
+// MergeLists merges the source list into the target list and deletes the source list.
+// Source leads whose email already exists in the target are folded into the existing
+// lead: conflicting lead_data keys are resolved by strategy and the most recent
+// verification result of the two is kept. All other source leads are moved over.
+//
+// The source leads are handled in batches that can each be applied twice without harm,
+// and the source list remembers the merge, so calling MergeLists again after it was
+// interrupted finishes the merge. A list can only be merged into one target at a time.
+func MergeLists(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, targetListID primitive.ObjectID, sourceListID primitive.ObjectID, strategy string) (MergeResult, error) {
+	var result MergeResult
+	if strategy == "" {
+		strategy = MergeKeepTarget
+	}
+	if strategy != MergeKeepTarget && strategy != MergeKeepSource {
+		return result, errors.New("unknown merge strategy: " + strategy)
+	}
+	if targetListID == sourceListID {
+		return result, errors.New("cannot merge a list into itself")
+	}
+
+	err := startListMerge(ctx, client, workspaceID, targetListID, sourceListID)
+	if err != nil {
+		return result, err
+	}
+	for {
+		done, err := mergeLeadsBatch(ctx, client, workspaceID, targetListID, sourceListID, strategy == MergeKeepSource)
+		if err != nil {
+			return result, err
+		}
+		if done {
+			break
+		}
+	}
+
+	// the counts cover earlier attempts of the same merge as well
+	source, err := GetList(ctx, client, workspaceID, sourceListID)
+	if err != nil {
+		return result, err
+	}
+	if source.Merge != nil {
+		result.Moved, result.Merged = source.Merge.Moved, source.Merge.Merged
+	}
+	err = DeleteList(ctx, client, workspaceID, sourceListID)
+	return result, err
+}
+
+// startListMerge records on the source list that it is being merged into the target,
+// failing when it is already being merged into another list
+func startListMerge(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, targetListID primitive.ObjectID, sourceListID primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("lists")
+	res, err := collection.UpdateOne(ctx, bson.M{
+		"_id":          sourceListID,
+		"workspace_id": workspaceID,
+		"deleted_at":   bson.M{"$exists": false},
+		"$or": bson.A{
+			bson.M{"merge": bson.M{"$exists": false}},
+			bson.M{"merge.target_list_id": targetListID},
+		},
+	}, bson.M{"$set": bson.M{"merge.target_list_id": targetListID}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		_, err = GetList(ctx, client, workspaceID, sourceListID)
+		if err != nil {
+			return err
+		}
+		return conflict("the source list is already being merged into another list")
+	}
+	return nil
 }
 
-func DeleteList(client *mongo.Client, id primitive.ObjectID) error {
-	collection := client.Database("email_verify").Collection("lists")
-	_, err := collection.DeleteOne(context.TODO(), bson.M{"_id": id})
+// mergeLeadsBatch merges the next batch of source leads into the target list and reports
+// whether the source list has no leads left. Leads leave the source list only after their
+// changes are written, so a batch that is cut short is simply done again.
+func mergeLeadsBatch(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, targetListID primitive.ObjectID, sourceListID primitive.ObjectID, sourceWins bool) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.BulkTimeout)
+	defer cancel()
+
+	leadsCollection := client.Database(config.Database).Collection("leads")
+	cursor, err := leadsCollection.Find(ctx, bson.M{"list_id": sourceListID, "workspace_id": workspaceID}, options.Find().SetSort(bson.M{"_id": 1}).SetLimit(mergeBatchSize))
+	if err != nil {
+		return false, err
+	}
+	var sourceLeads []Lead
+	err = cursor.All(ctx, &sourceLeads)
+	if err != nil {
+		return false, err
+	}
+	if len(sourceLeads) == 0 {
+		return true, nil
+	}
+
+	emails := make([]string, len(sourceLeads))
+	for i, lead := range sourceLeads {
+		emails[i] = lead.Email
+	}
+	// emails are matched regardless of case
+	cursor, err = leadsCollection.Find(ctx, bson.M{"list_id": targetListID, "workspace_id": workspaceID, "email": bson.M{"$in": emails}},
+		options.Find().SetCollation(&options.Collation{Locale: "en", Strength: 2}))
+	if err != nil {
+		return false, err
+	}
+	var targetLeads []Lead
+	err = cursor.All(ctx, &targetLeads)
+	if err != nil {
+		return false, err
+	}
+	byEmail := make(map[string]Lead)
+	for _, lead := range targetLeads {
+		byEmail[strings.ToLower(lead.Email)] = lead
+	}
+
+	var models []mongo.WriteModel
+	var movedIDs, mergedIDs []primitive.ObjectID
+	for _, source := range sourceLeads {
+		key := strings.ToLower(source.Email)
+		target, exists := byEmail[key]
+		if !exists {
+			movedIDs = append(movedIDs, source.ID)
+			source.ListID = targetListID
+			byEmail[key] = source
+			continue
+		}
+
+		target.LeadData = mergeLeadData(target.LeadData, source.LeadData, sourceWins)
+		set := bson.M{"lead_data": target.LeadData}
+		if isNewerVerification(source, target) {
+			target.EmailVerified, target.EmailIsValid = source.EmailVerified, source.EmailIsValid
+			target.VerificationResult, target.VerifiedAt = source.VerificationResult, source.VerifiedAt
+			set["email_verified"] = source.EmailVerified
+			set["email_is_valid"] = source.EmailIsValid
+			set["verification_result"] = source.VerificationResult
+			set["verified_at"] = source.VerifiedAt
+		}
+		// later duplicates in the source merge against the updated lead
+		byEmail[key] = target
+		models = append(models, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": target.ID, "workspace_id": workspaceID}).SetUpdate(bson.M{"$set": set}))
+		mergedIDs = append(mergedIDs, source.ID)
+	}
+
+	// the target leads are updated first, the source leads leave the source list last
+	if len(models) > 0 {
+		_, err = leadsCollection.BulkWrite(ctx, models)
+		if err != nil {
+			return false, err
+		}
+	}
+	if len(movedIDs) > 0 {
+		_, err = moveQueueItems(ctx, client, workspaceID, movedIDs, targetListID)
+		if err != nil {
+			return false, err
+		}
+		_, err = leadsCollection.UpdateMany(ctx, bson.M{"_id": bson.M{"$in": movedIDs}, "workspace_id": workspaceID}, bson.M{"$set": bson.M{"list_id": targetListID}})
+		if err != nil {
+			return false, err
+		}
+	}
+	if len(mergedIDs) > 0 {
+		_, err = dequeueLeads(ctx, client, workspaceID, sourceListID, mergedIDs)
+		if err != nil {
+			return false, err
+		}
+		_, err = leadsCollection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": mergedIDs}, "workspace_id": workspaceID})
+		if err != nil {
+			return false, err
+		}
+	}
+
+	listsCollection := client.Database(config.Database).Collection("lists")
+	_, err = listsCollection.UpdateOne(ctx, bson.M{"_id": sourceListID, "workspace_id": workspaceID},
+		bson.M{"$inc": bson.M{"merge.moved": len(movedIDs), "merge.merged": len(mergedIDs)}})
+	return len(sourceLeads) < mergeBatchSize, err
+}
+
+// mergeLeadData combines two lead_data documents keeping the target's key order.
+// Keys only present in the source are appended, keys present in both take the
+// source value when sourceWins is set.
+func mergeLeadData(target any, source any, sourceWins bool) primitive.D {
+	merged := toDocument(target)
+	index := make(map[string]int)
+	for i, e := range merged {
+		index[e.Key] = i
+	}
+	for _, e := range toDocument(source) {
+		i, exists := index[e.Key]
+		if !exists {
+			index[e.Key] = len(merged)
+			merged = append(merged, e)
+		} else if sourceWins {
+			merged[i].Value = e.Value
+		}
+	}
+	return merged
+}
+
+// toDocument converts a decoded lead_data value into an ordered document
+func toDocument(data any) primitive.D {
+	switch d := data.(type) {
+	case primitive.D:
+		return append(primitive.D{}, d...)
+	case map[string]interface{}:
+		doc := primitive.D{}
+		for k, v := range d {
+			doc = append(doc, primitive.E{Key: k, Value: v})
+		}
+		return doc
+	case primitive.M:
+		doc := primitive.D{}
+		for k, v := range d {
+			doc = append(doc, primitive.E{Key: k, Value: v})
+		}
+		return doc
+	}
+	return primitive.D{}
+}
+
+// isNewerVerification reports whether a holds a more recent verification result than b
+func isNewerVerification(a Lead, b Lead) bool {
+	if !a.EmailVerified {
+		return false
+	}
+	if !b.EmailVerified {
+		return true
+	}
+	if a.VerifiedAt == nil {
+		return false
+	}
+	return b.VerifiedAt == nil || a.VerifiedAt.After(*b.VerifiedAt)
+}
+
+// GetTrashedLists returns the lists that were soft deleted and can still be restored
+func GetTrashedLists(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID) ([]List, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("lists")
+	cursor, err := collection.Find(ctx, bson.M{"workspace_id": workspaceID, "deleted_at": bson.M{"$exists": true}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var lists []List
+	for cursor.Next(ctx) {
+		var list List
+		cursor.Decode(&list)
+		lists = append(lists, list)
+	}
+	return lists, cursor.Err()
+}
+
+// DeleteList removes the list together with its leads and any pending queue items
+func DeleteList(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, id primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(ctx, config.BulkTimeout)
+	defer cancel()
+
+	// remove the queue items first so the worker stops picking up leads of this list
+	_, err := deleteQueueItems(ctx, client, workspaceID, bson.M{"list_id": id})
+	if err != nil {
+		return err
+	}
+
+	leadsCollection := client.Database(config.Database).Collection("leads")
+	_, err = leadsCollection.DeleteMany(ctx, bson.M{"list_id": id, "workspace_id": workspaceID})
+	if err != nil {
+		return err
+	}
+
+	collection := client.Database(config.Database).Collection("lists")
+	res, err := collection.DeleteOne(ctx, bson.M{"_id": id, "workspace_id": workspaceID})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// TrashList soft deletes the list: it and its leads are hidden from every read and its
+// pending queue items are dropped, but the list and its leads are kept until purged
+func TrashList(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, id primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(ctx, config.BulkTimeout)
+	defer cancel()
+
+	deletedAt := time.Now()
+	collection := client.Database(config.Database).Collection("lists")
+	res, err := collection.UpdateOne(ctx, bson.M{"_id": id, "workspace_id": workspaceID, "deleted_at": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"deleted_at": deletedAt}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	_, err = deleteQueueItems(ctx, client, workspaceID, bson.M{"list_id": id})
+	if err != nil {
+		return err
+	}
+
+	// the leads carry the mark too so workspace wide reads such as count_all skip them
+	leadsCollection := client.Database(config.Database).Collection("leads")
+	_, err = leadsCollection.UpdateMany(ctx, bson.M{"list_id": id, "workspace_id": workspaceID}, bson.M{"$set": bson.M{"deleted_at": deletedAt}})
 	return err
 }
+
+// RestoreList brings a trashed list back together with its leads
+func RestoreList(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, id primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(ctx, config.BulkTimeout)
+	defer cancel()
+
+	_, err := GetTrashedList(ctx, client, workspaceID, id)
+	if err != nil {
+		return err
+	}
+
+	leadsCollection := client.Database(config.Database).Collection("leads")
+	_, err = leadsCollection.UpdateMany(ctx, bson.M{"list_id": id, "workspace_id": workspaceID}, bson.M{"$unset": bson.M{"deleted_at": ""}})
+	if err != nil {
+		return err
+	}
+
+	collection := client.Database(config.Database).Collection("lists")
+	res, err := collection.UpdateOne(ctx, bson.M{"_id": id, "workspace_id": workspaceID, "deleted_at": bson.M{"$exists": true}}, bson.M{"$unset": bson.M{"deleted_at": ""}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// PurgeTrashedLists permanently deletes lists that have been in the trash for longer than retention
+func PurgeTrashedLists(ctx context.Context, client *mongo.Client, retention time.Duration) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.BulkTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("lists")
+	cursor, err := collection.Find(ctx, bson.M{"deleted_at": bson.M{"$lt": time.Now().Add(-retention)}})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var expired []List
+	for cursor.Next(ctx) {
+		var list List
+		cursor.Decode(&list)
+		expired = append(expired, list)
+	}
+
+	purged := 0
+	for _, list := range expired {
+		// skip lists restored since they were found
+		_, err = GetTrashedList(ctx, client, list.WorkspaceID, list.ID)
+		if err == mongo.ErrNoDocuments {
+			continue
+		}
+		if err != nil {
+			return purged, err
+		}
+		err = DeleteList(ctx, client, list.WorkspaceID, list.ID)
+		if err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// purgeTrashPeriodically runs PurgeTrashedLists on a fixed interval until ctx is cancelled
+func purgeTrashPeriodically(ctx context.Context, client *mongo.Client) {
+	ticker := time.NewTicker(listTrashPurgeInterval)
+	defer ticker.Stop()
+	for {
+		purged, err := PurgeTrashedLists(ctx, client, config.ListTrashRetention)
+		if err != nil {
+			slog.Error("purging trashed lists", "error", err)
+		} else if purged > 0 {
+			slog.Info("purged trashed lists", "count", purged)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
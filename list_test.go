@@ -0,0 +1,73 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMergeLeadData(t *testing.T) {
+	target := primitive.D{{Key: "name", Value: "Jane"}, {Key: "company", Value: "Acme"}}
+	tests := []struct {
+		name       string
+		target     any
+		source     any
+		sourceWins bool
+		want       primitive.D
+	}{
+		{
+			name:   "source keys are appended in order",
+			target: target,
+			source: primitive.D{{Key: "phone", Value: "123"}, {Key: "city", Value: "Oslo"}},
+			want:   primitive.D{{Key: "name", Value: "Jane"}, {Key: "company", Value: "Acme"}, {Key: "phone", Value: "123"}, {Key: "city", Value: "Oslo"}},
+		},
+		{
+			name:   "target wins by default",
+			target: target,
+			source: primitive.D{{Key: "company", Value: "Initech"}},
+			want:   primitive.D{{Key: "name", Value: "Jane"}, {Key: "company", Value: "Acme"}},
+		},
+		{
+			name:       "source wins keeps the target's order",
+			target:     target,
+			source:     primitive.D{{Key: "company", Value: "Initech"}, {Key: "name", Value: "Janet"}},
+			sourceWins: true,
+			want:       primitive.D{{Key: "name", Value: "Janet"}, {Key: "company", Value: "Initech"}},
+		},
+		{
+			name:   "missing target",
+			target: nil,
+			source: map[string]interface{}{"name": "Jane"},
+			want:   primitive.D{{Key: "name", Value: "Jane"}},
+		},
+		{
+			name:   "missing source",
+			target: primitive.M{"name": "Jane"},
+			source: nil,
+			want:   primitive.D{{Key: "name", Value: "Jane"}},
+		},
+		{
+			name:   "both missing",
+			target: nil,
+			source: "not a document",
+			want:   primitive.D{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mergeLeadData(tt.target, tt.source, tt.sourceWins)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mergeLeadData() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeLeadDataLeavesTargetAlone(t *testing.T) {
+	target := primitive.D{{Key: "name", Value: "Jane"}}
+	mergeLeadData(target, primitive.D{{Key: "name", Value: "Janet"}}, true)
+	if target[0].Value != "Jane" {
+		t.Errorf("mergeLeadData changed the target to %v", target)
+	}
+}
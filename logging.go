@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// setupLogging makes slog write JSON lines to stdout from level up. Messages of the
+// standard log package end up there too.
+func setupLogging(level string) error {
+	var lvl slog.Level
+	err := lvl.UnmarshalText([]byte(level))
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: lvl})))
+	return nil
+}
+
+// fatal logs err and exits, for errors that keep the service from starting
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+type loggerContextKey struct{}
+
+// withLogger returns a copy of ctx carrying logger
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, logger)
+}
+
+// loggerFromContext returns the logger of ctx with its correlation IDs, or the default logger
+func loggerFromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerContextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// newCorrelationID returns a random ID for a request or a worker run
+func newCorrelationID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+type requestIDContextKey struct{}
+
+// requestIDFromContext returns the ID of the request ctx belongs to
+func requestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDContextKey{}).(string)
+	return requestID
+}
+
+// validRequestID accepts IDs set by a proxy in front of the service as long as they are
+// short and printable, so they can't forge log lines
+func validRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > 64 {
+		return false
+	}
+	for _, c := range requestID {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// logRequests gives every request an ID, taken from the X-Request-ID header when present,
+// returns it in the X-Request-ID response header and logs the request once it is handled.
+// Handlers log through loggerFromContext so their lines carry the ID as well.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		requestID := r.Header.Get("X-Request-ID")
+		if !validRequestID(requestID) {
+			requestID = newCorrelationID()
+		}
+		w.Header().Set("X-Request-ID", requestID)
+		logger := slog.Default().With("request_id", requestID)
+		ctx := context.WithValue(withLogger(r.Context(), logger), requestIDContextKey{}, requestID)
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		level := slog.LevelInfo
+		if recorder.status >= 500 {
+			level = slog.LevelError
+		}
+		logger.Log(ctx, level, "request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", recorder.status,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"api_key_id", w.Header().Get("X-API-Key-ID"),
+		)
+	})
+}
@@ -3,10 +3,22 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -14,9 +26,15 @@ import (
 
 func enableCORSAndJSONContentType(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+		if slices.Contains(config.CORSAllowedOrigins, "*") {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else if origin := r.Header.Get("Origin"); slices.Contains(config.CORSAllowedOrigins, origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Add("Vary", "Origin")
+		}
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, PATCH, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, X-API-Key")
+		w.Header().Set("Access-Control-Expose-Headers", "X-API-Key-ID")
 		w.Header().Set("Content-Type", "application/json")
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -26,322 +44,1680 @@ func enableCORSAndJSONContentType(next http.Handler) http.Handler {
 	})
 }
 
+// requestWorkspaceID returns the workspace of the API key the request was made with,
+// all data access of the request is scoped to it
+func requestWorkspaceID(r *http.Request) primitive.ObjectID {
+	apiKey, _ := apiKeyFromContext(r.Context())
+	return apiKey.WorkspaceID
+}
+
+// parseObjectIDs converts a list of hex ids, failing on the first invalid one
+func parseObjectIDs(hexIDs []string) ([]primitive.ObjectID, error) {
+	var ids []primitive.ObjectID
+	for _, hexID := range hexIDs {
+		id, err := primitive.ObjectIDFromHex(hexID)
+		if err != nil {
+			return nil, invalidID(strconv.Quote(hexID))
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// parseDuration is time.ParseDuration with an additional "d" unit for days, e.g. "30d"
+func parseDuration(raw string) (time.Duration, error) {
+	if days, found := strings.CutSuffix(raw, "d"); found {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, errors.New("invalid duration: " + raw)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(raw)
+}
+
+// throughputWindow reads the ?window= duration for the queue status endpoints
+func throughputWindow(r *http.Request) (time.Duration, error) {
+	raw := r.URL.Query().Get("window")
+	if raw == "" {
+		return queueThroughputWindow, nil
+	}
+	window, err := parseDuration(raw)
+	if err != nil {
+		return 0, err
+	}
+	if window <= 0 {
+		return 0, errors.New("window must be positive")
+	}
+	return window, nil
+}
+
 func main() {
-	client, err := mongo.Connect(context.TODO(), options.Client().ApplyURI("mongodb://localhost:27017/email"))
+	cfg, err := LoadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	config = cfg
+	// the level was validated along with the rest of the configuration
+	setupLogging(config.LogLevel)
+
+	// cancelled on SIGINT or SIGTERM, which starts the shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	client, err := mongo.Connect(context.TODO(), options.Client().ApplyURI(config.MongoURI))
 	if err != nil {
-		log.Fatal(err)
+		fatal("connecting to MongoDB", err)
 	}
 	defer client.Disconnect(context.TODO())
 
+	err = EnsureIndexes(ctx, client)
+	if err != nil {
+		fatal("creating indexes", err)
+	}
+
+	err = EnsureListEventsCollection(ctx, client)
+	if err != nil {
+		fatal("creating the list events collection", err)
+	}
+
+	defaultWorkspace, err := EnsureDefaultWorkspace(ctx, client)
+	if err != nil {
+		fatal("creating the default workspace", err)
+	}
+
+	if config.BootstrapAPIKey != "" {
+		err = EnsureBootstrapAPIKey(ctx, client, defaultWorkspace.ID, config.BootstrapAPIKey)
+		if err != nil {
+			fatal("creating the bootstrap API key", err)
+		}
+	}
+
+	worker := newQueueWorker()
+
+	go purgeTrashPeriodically(ctx, client)
+	go loadDomainListsPeriodically(ctx, client)
+	go deliverWebhooksPeriodically(ctx, client)
+
 	router := httprouter.New()
+	router.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, notFound("no route for "+r.URL.Path))
+	})
+	router.MethodNotAllowed = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, &APIError{Status: http.StatusMethodNotAllowed, Code: CodeMethodNotAllowed, Message: r.Method + " is not allowed on " + r.URL.Path})
+	})
+	router.PanicHandler = func(w http.ResponseWriter, r *http.Request, v interface{}) {
+		writeError(w, r, fmt.Errorf("panic: %v", v))
+	}
 	// list crud routes
-	router.GET("/lists", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-		lists, err := GetLists(client)
+	router.GET("/lists", requireScope(ScopeReadLists, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		lists, err := GetLists(r.Context(), client, requestWorkspaceID(r))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
 		json.NewEncoder(w).Encode(lists)
-	})
+	}))
+
+	router.POST("/lists", requireScope(ScopeWriteLists, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		var reqBody struct {
+			Name string `json:"name"`
+		}
+		err := decodeJSONBody(r, &reqBody)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		var errs fieldErrors
+		reqBody.Name = strings.TrimSpace(reqBody.Name)
+		if reqBody.Name == "" {
+			errs.add("name", "is required")
+		} else if len(reqBody.Name) > maxListNameLength {
+			errs.add("name", "must not be longer than 200 characters")
+		}
+		if errs.err() != nil {
+			writeError(w, r, errs.err())
+			return
+		}
+		id, err := CreateList(r.Context(), client, requestWorkspaceID(r), reqBody.Name)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(List{ID: id, WorkspaceID: requestWorkspaceID(r), Name: reqBody.Name})
+	}))
 
-	router.POST("/lists", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-		var list List
-		json.NewDecoder(r.Body).Decode(&list)
-		id, err := CreateList(client, list.Name)
+	router.GET("/lists/:id", requireScope(ScopeReadLists, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, invalidID("id"))
+			return
+		}
+		list, err := GetList(r.Context(), client, requestWorkspaceID(r), id)
+		if err != nil {
+			writeError(w, r, err)
 			return
 		}
-		list.ID = id
 		json.NewEncoder(w).Encode(list)
-	})
+	}))
 
-	router.GET("/lists/:id", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	router.PATCH("/lists/:id", requireScope(ScopeWriteLists, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeError(w, r, invalidID("id"))
+			return
+		}
+		var reqBody struct {
+			Name          *string                `json:"name"`
+			QueuePriority *int                   `json:"queue_priority"`
+			Metadata      map[string]interface{} `json:"metadata"`
+		}
+		err = decodeJSONBody(r, &reqBody)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		var errs fieldErrors
+		if reqBody.Name != nil {
+			*reqBody.Name = strings.TrimSpace(*reqBody.Name)
+			if *reqBody.Name == "" {
+				errs.add("name", "must not be empty")
+			} else if len(*reqBody.Name) > maxListNameLength {
+				errs.add("name", "must not be longer than 200 characters")
+			}
+		}
+		for key := range reqBody.Metadata {
+			if !validDocumentKey(key) {
+				errs.add("metadata", "invalid key: "+key)
+			}
+		}
+		if errs.err() != nil {
+			writeError(w, r, errs.err())
+			return
+		}
+		list, err := UpdateList(r.Context(), client, requestWorkspaceID(r), id, reqBody.Name, reqBody.QueuePriority, reqBody.Metadata)
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, notFound("list not found"))
 			return
 		}
-		list, err := GetList(client, id)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
 		json.NewEncoder(w).Encode(list)
-	})
+	}))
 
-	router.DELETE("/lists/:id", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	router.DELETE("/lists/:id", requireScope(ScopeWriteLists, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeError(w, r, invalidID("id"))
+			return
+		}
+		// ?trash=true moves the list to the trash instead of deleting it for good
+		if r.URL.Query().Get("trash") == "true" {
+			err = TrashList(r.Context(), client, requestWorkspaceID(r), id)
+		} else {
+			err = DeleteList(r.Context(), client, requestWorkspaceID(r), id)
+		}
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, notFound("list not found"))
 			return
 		}
-		err = DeleteList(client, id)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
 		w.WriteHeader(http.StatusNoContent)
-	})
+	}))
+
+	// trashed lists
+
+	router.GET("/trash/lists", requireScope(ScopeReadLists, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		lists, err := GetTrashedLists(r.Context(), client, requestWorkspaceID(r))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(lists)
+	}))
+
+	router.POST("/lists/:id/restore", requireScope(ScopeWriteLists, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
+		if err != nil {
+			writeError(w, r, invalidID("id"))
+			return
+		}
+		err = RestoreList(r.Context(), client, requestWorkspaceID(r), id)
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, notFound("list not found"))
+			return
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
 
 	// lead crud routes
 
-	router.GET("/leads", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-		leads, err := GetLeads(client, primitive.NilObjectID)
+	router.GET("/leads", requireScope(ScopeReadLeads, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		leads, err := GetLeads(r.Context(), client, requestWorkspaceID(r), primitive.NilObjectID)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
 		json.NewEncoder(w).Encode(leads)
-	})
+	}))
 
-	router.POST("/leads", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	router.POST("/leads", requireScope(ScopeWriteLeads, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		var reqBody struct {
-			Email  string `json:"email"`
-			ListID string `json:"list_id"`
+			Email    string                 `json:"email"`
+			ListID   string                 `json:"list_id"`
+			LeadData map[string]interface{} `json:"lead_data"`
+			// "queue" queues the new lead for verification, "sync" verifies it before responding
+			Verify string `json:"verify"`
+		}
+		err := decodeJSONBody(r, &reqBody)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		var errs fieldErrors
+		reqBody.Email = strings.TrimSpace(reqBody.Email)
+		validateEmail(&errs, "email", reqBody.Email)
+		for key := range reqBody.LeadData {
+			if !validDocumentKey(key) {
+				errs.add("lead_data", "invalid key: "+key)
+			}
+		}
+		if reqBody.Verify != "" && reqBody.Verify != VerifyQueue && reqBody.Verify != VerifySync {
+			errs.add("verify", "must be queue or sync")
+		}
+		listID, err := primitive.ObjectIDFromHex(reqBody.ListID)
+		if reqBody.ListID == "" {
+			errs.add("list_id", "is required")
+		} else if err != nil {
+			errs.add("list_id", "is not a valid id")
+		} else {
+			// the list must exist in the caller's workspace
+			_, err = GetList(r.Context(), client, requestWorkspaceID(r), listID)
+			if err == mongo.ErrNoDocuments {
+				errs.add("list_id", "no list with this id")
+			} else if err != nil {
+				writeError(w, r, err)
+				return
+			}
+		}
+		if errs.err() != nil {
+			writeError(w, r, errs.err())
+			return
+		}
+		leadData := reqBody.LeadData
+		if leadData == nil {
+			leadData = make(map[string]interface{})
+		}
+		lead := Lead{WorkspaceID: requestWorkspaceID(r), Email: reqBody.Email, ListID: listID, LeadData: leadData}
+		lead.ID, err = CreateLead(r.Context(), client, lead.WorkspaceID, lead.Email, lead.ListID, leadData)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		var verified Lead
+		switch reqBody.Verify {
+		case VerifyQueue:
+			verified, err = EnqueueLead(r.Context(), client, lead.WorkspaceID, lead)
+		case VerifySync:
+			verified, err = VerifyLeadNow(r.Context(), client, lead.WorkspaceID, lead)
+		}
+		// the lead exists either way, so a failed verification is reported along with it
+		var verifyError *verifyFailure
+		if err != nil {
+			apiErr := apiErrorFor(err)
+			if apiErr.Status >= 500 {
+				loggerFromContext(r.Context()).Error("verifying new lead", "lead_id", lead.ID.Hex(), "error", err)
+			}
+			verifyError = &verifyFailure{apiErr.Code, apiErr.Message}
+		} else if reqBody.Verify != "" {
+			lead = verified
 		}
-		json.NewDecoder(r.Body).Decode(&reqBody)
-		var lead Lead
-		json.NewDecoder(r.Body).Decode(&lead)
-		lead.ListID, err = primitive.ObjectIDFromHex(reqBody.ListID)
-		lead.Email = reqBody.Email
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(struct {
+			Lead
+			VerifyError *verifyFailure `json:"verify_error,omitempty"`
+		}{lead, verifyError})
+	}))
+
+	router.GET("/leads/:id", requireScope(ScopeReadLeads, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeError(w, r, invalidID("id"))
 			return
 		}
-		leadData := make(map[string]interface{})
-		id, err := CreateLead(client, lead.Email, lead.ListID, leadData)
+		lead, err := GetLead(r.Context(), client, requestWorkspaceID(r), id)
+
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
-		lead.ID = id
 		json.NewEncoder(w).Encode(lead)
-	})
+	}))
 
-	router.GET("/leads/:id", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	router.PATCH("/leads/:id", requireScope(ScopeWriteLeads, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeError(w, r, invalidID("id"))
+			return
+		}
+		var reqBody struct {
+			Email    *string                `json:"email"`
+			LeadData map[string]interface{} `json:"lead_data"`
+			// re-queue the lead for verification when its email changed
+			Requeue bool `json:"requeue"`
+		}
+		err = decodeJSONBody(r, &reqBody)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		var errs fieldErrors
+		if reqBody.Email != nil {
+			*reqBody.Email = strings.TrimSpace(*reqBody.Email)
+			validateEmail(&errs, "email", *reqBody.Email)
+		}
+		for key := range reqBody.LeadData {
+			if !validDocumentKey(key) {
+				errs.add("lead_data", "invalid key: "+key)
+			}
+		}
+		if errs.err() != nil {
+			writeError(w, r, errs.err())
+			return
+		}
+		lead, emailChanged, err := UpdateLead(r.Context(), client, requestWorkspaceID(r), id, reqBody.Email, reqBody.LeadData)
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, notFound("lead not found"))
 			return
 		}
-		lead, err := GetLead(client, id)
-
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
+		if emailChanged && reqBody.Requeue {
+			lead, err = EnqueueLead(r.Context(), client, requestWorkspaceID(r), lead)
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+		}
 		json.NewEncoder(w).Encode(lead)
-	})
+	}))
 
-	router.DELETE("/leads/:id", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	router.DELETE("/leads/:id", requireScope(ScopeWriteLeads, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeError(w, r, invalidID("id"))
 			return
 		}
-		err = DeleteLead(client, id)
+		err = DeleteLead(r.Context(), client, requestWorkspaceID(r), id)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
 		w.WriteHeader(http.StatusNoContent)
-	})
+	}))
 
 	// get leads by list id
 
-	router.GET("/lists/:id/leads", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	router.GET("/lists/:id/leads", requireScope(ScopeReadLeads, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeError(w, r, invalidID("id"))
 			return
 		}
-		leads, err := GetLeads(client, id)
+		leads, err := GetLeads(r.Context(), client, requestWorkspaceID(r), id)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
 		json.NewEncoder(w).Encode(leads)
-	})
-
-	// get leads count by list id
+	}))
 
-	router.GET("/lists/:id/leads/count", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	router.POST("/lists/:id/leads/bulk", requireScope(ScopeWriteLeads, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeError(w, r, invalidID("id"))
 			return
 		}
-		count, err := GetLeadsCount(client, id)
+		var reqBody struct {
+			Leads []struct {
+				Email    string                 `json:"email"`
+				LeadData map[string]interface{} `json:"lead_data"`
+			} `json:"leads"`
+		}
+		err = decodeJSONBody(r, &reqBody)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, err)
+			return
+		}
+		var errs fieldErrors
+		if len(reqBody.Leads) == 0 {
+			errs.add("leads", "is required")
+		} else if len(reqBody.Leads) > maxBulkLeads {
+			errs.add("leads", "must not contain more than "+strconv.Itoa(maxBulkLeads)+" leads")
+		}
+		if errs.err() != nil {
+			writeError(w, r, errs.err())
 			return
 		}
-		json.NewEncoder(w).Encode(count)
-	})
 
-	// get leads count by list id and email_verified = true
+		// invalid leads are reported without keeping the valid ones from being created
+		type leadResult struct {
+			Index  int                 `json:"index"`
+			ID     *primitive.ObjectID `json:"id,omitempty"`
+			Errors []FieldError        `json:"errors,omitempty"`
+		}
+		results := make([]leadResult, len(reqBody.Leads))
+		var leads []Lead
+		var indexes []int
+		for i, item := range reqBody.Leads {
+			var errs fieldErrors
+			email := strings.TrimSpace(item.Email)
+			validateEmail(&errs, "email", email)
+			for key := range item.LeadData {
+				if !validDocumentKey(key) {
+					errs.add("lead_data", "invalid key: "+key)
+				}
+			}
+			results[i] = leadResult{Index: i, Errors: errs}
+			if len(errs) > 0 {
+				continue
+			}
+			leadData := item.LeadData
+			if leadData == nil {
+				leadData = make(map[string]interface{})
+			}
+			leads = append(leads, Lead{Email: email, LeadData: leadData})
+			indexes = append(indexes, i)
+		}
+		insertErrs, err := CreateLeads(r.Context(), client, requestWorkspaceID(r), id, leads)
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, notFound("list not found"))
+			return
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		created := 0
+		for j, lead := range leads {
+			i := indexes[j]
+			if insertErrs[j] != nil {
+				loggerFromContext(r.Context()).Error("storing lead", "index", i, "error", insertErrs[j])
+				results[i].Errors = []FieldError{{Field: "lead", Message: "could not be stored"}}
+				continue
+			}
+			results[i].ID = &lead.ID
+			created++
+		}
+		JsonResponse := struct {
+			Created int          `json:"created"`
+			Failed  int          `json:"failed"`
+			Results []leadResult `json:"results"`
+		}{
+			Created: created,
+			Failed:  len(results) - created,
+			Results: results}
+		json.NewEncoder(w).Encode(JsonResponse)
+	}))
 
-	router.GET("/lists/:id/leads/count/email_verified", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	router.DELETE("/lists/:id/leads", requireScope(ScopeWriteLeads, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeError(w, r, invalidID("id"))
 			return
 		}
-		count, err := CountEmailVerified(client, id)
+		var reqBody struct {
+			LeadIDs []string    `json:"lead_ids"`
+			Filter  *LeadFilter `json:"filter"`
+		}
+		err = decodeJSONBody(r, &reqBody)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
-		json.NewEncoder(w).Encode(count)
-	})
-
-	// get leads count by list id and email_is_valid = yes
-
-	router.GET("/lists/:id/leads/count/valid_emails", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-		id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
+		// an empty body must not delete the whole list by accident, {"filter": {}} does that on purpose
+		if len(reqBody.LeadIDs) == 0 && reqBody.Filter == nil {
+			writeError(w, r, badRequest("lead_ids or filter is required"))
+			return
+		}
+		leadIDs, err := parseObjectIDs(reqBody.LeadIDs)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeError(w, r, err)
+			return
+		}
+		_, err = GetList(r.Context(), client, requestWorkspaceID(r), id)
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, notFound("list not found"))
 			return
 		}
-		count, err := CountValidEmails(client, id)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
-		json.NewEncoder(w).Encode(count)
-	})
+		deleted, dequeued, err := DeleteLeads(r.Context(), client, requestWorkspaceID(r), id, leadSelector(requestWorkspaceID(r), id, leadIDs, reqBody.Filter))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		JsonResponse := struct {
+			Deleted  int64 `json:"deleted"`
+			Dequeued int64 `json:"dequeued"`
+		}{
+			Deleted:  deleted,
+			Dequeued: dequeued}
+		json.NewEncoder(w).Encode(JsonResponse)
+	}))
 
-	// get leads count by list id and email_is_valid = no
+	// move, copy and merge leads between lists
 
-	router.GET("/lists/:id/leads/count/invalid_emails", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	router.POST("/lists/:id/leads/move", requireScope(ScopeWriteLeads, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeError(w, r, invalidID("id"))
 			return
 		}
-		count, err := CountInvalidEmails(client, id)
+		var reqBody struct {
+			TargetListID string      `json:"target_list_id"`
+			LeadIDs      []string    `json:"lead_ids"`
+			Filter       *LeadFilter `json:"filter"`
+		}
+		err = decodeJSONBody(r, &reqBody)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
-		json.NewEncoder(w).Encode(count)
-	})
-
-	// get leads count by list id and email_is_valid = unknown
-
-	router.GET("/lists/:id/leads/count/unknown_emails", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-		id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
+		// refuse an empty selection so a forgotten body doesn't move the whole list
+		if len(reqBody.LeadIDs) == 0 && reqBody.Filter == nil {
+			writeError(w, r, badRequest("lead_ids or filter is required"))
+			return
+		}
+		targetID, err := primitive.ObjectIDFromHex(reqBody.TargetListID)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeError(w, r, invalidID("target_list_id"))
+			return
+		}
+		if targetID == id {
+			writeError(w, r, badRequest("target_list_id must differ from the source list"))
+			return
+		}
+		_, err = GetList(r.Context(), client, requestWorkspaceID(r), targetID)
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, notFound("target list not found"))
 			return
 		}
-		count, err := CountUnknownEmails(client, id)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
-		json.NewEncoder(w).Encode(count)
-	})
-
-	// count for all emails no matter the list
-
-	router.GET("/count_all", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-		emailIsValid := r.URL.Query().Get("email_is_valid")
-		count, err := CountAllEmails(client, emailIsValid)
+		leadIDs, err := parseObjectIDs(reqBody.LeadIDs)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
-		json.NewEncoder(w).Encode(count)
-	})
+		count, err := MoveLeads(r.Context(), client, requestWorkspaceID(r), leadSelector(requestWorkspaceID(r), id, leadIDs, reqBody.Filter), targetID)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		JsonResponse := struct {
+			Moved int64 `json:"moved"`
+		}{
+			Moved: count}
+		json.NewEncoder(w).Encode(JsonResponse)
+	}))
 
-	router.POST("/lists/:id/queue", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	router.POST("/lists/:id/leads/copy", requireScope(ScopeWriteLeads, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeError(w, r, invalidID("id"))
 			return
 		}
-		err = AddListToQueue(client, id)
+		var reqBody struct {
+			TargetListID string      `json:"target_list_id"`
+			LeadIDs      []string    `json:"lead_ids"`
+			Filter       *LeadFilter `json:"filter"`
+		}
+		err = decodeJSONBody(r, &reqBody)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
-		w.WriteHeader(http.StatusNoContent)
-	})
-
-	// is list in queue
-
-	router.GET("/lists/:id/queue", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-		id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
+		// refuse an empty selection so a forgotten body doesn't copy the whole list
+		if len(reqBody.LeadIDs) == 0 && reqBody.Filter == nil {
+			writeError(w, r, badRequest("lead_ids or filter is required"))
+			return
+		}
+		targetID, err := primitive.ObjectIDFromHex(reqBody.TargetListID)
+		if err != nil {
+			writeError(w, r, invalidID("target_list_id"))
+			return
+		}
+		if targetID == id {
+			writeError(w, r, badRequest("target_list_id must differ from the source list"))
+			return
+		}
+		_, err = GetList(r.Context(), client, requestWorkspaceID(r), targetID)
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, notFound("target list not found"))
+			return
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		leadIDs, err := parseObjectIDs(reqBody.LeadIDs)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeError(w, r, err)
 			return
 		}
-		inQueue, err := IsListInQueue(client, id)
+		count, err := CopyLeads(r.Context(), client, requestWorkspaceID(r), leadSelector(requestWorkspaceID(r), id, leadIDs, reqBody.Filter), targetID)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
 		JsonResponse := struct {
-			InQueue bool `json:"in_queue"`
+			Copied int64 `json:"copied"`
 		}{
-			InQueue: inQueue}
+			Copied: count}
 		json.NewEncoder(w).Encode(JsonResponse)
-	})
-
-	// remove list from queue
+	}))
 
-	router.DELETE("/lists/:id/queue", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	router.POST("/lists/:id/merge", requireScope(ScopeWriteLists, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeError(w, r, invalidID("id"))
+			return
+		}
+		var reqBody struct {
+			SourceListID string `json:"source_list_id"`
+			Strategy     string `json:"lead_data_strategy"`
+		}
+		err = decodeJSONBody(r, &reqBody)
+		if err != nil {
+			writeError(w, r, err)
 			return
 		}
-		err = RemoveListFromQueue(client, id)
+		sourceID, err := primitive.ObjectIDFromHex(reqBody.SourceListID)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, invalidID("source_list_id"))
 			return
 		}
-		w.WriteHeader(http.StatusNoContent)
-	})
-
-	router.GET("/processQueue", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-		go processQueue(client)
-		w.WriteHeader(http.StatusNoContent)
-	})
+		if sourceID == id {
+			writeError(w, r, badRequest("source_list_id must differ from the target list"))
+			return
+		}
+		if reqBody.Strategy != "" && reqBody.Strategy != MergeKeepTarget && reqBody.Strategy != MergeKeepSource {
+			writeError(w, r, badRequest("lead_data_strategy must be keep_target or keep_source"))
+			return
+		}
+		for _, listID := range []primitive.ObjectID{id, sourceID} {
+			_, err = GetList(r.Context(), client, requestWorkspaceID(r), listID)
+			if err == mongo.ErrNoDocuments {
+				writeError(w, r, notFound("list "+listID.Hex()+" not found"))
+				return
+			}
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+		}
+		result, err := MergeLists(r.Context(), client, requestWorkspaceID(r), id, sourceID, reqBody.Strategy)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(result)
+	}))
 
-	// get data from csv file and add to list
+	// get leads count by list id
 
-	router.POST("/lists/:id/leads/csv", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	router.GET("/lists/:id/leads/count", requireScope(ScopeReadLeads, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeError(w, r, invalidID("id"))
 			return
 		}
-		err = AddLeadsFromCSV(client, id, r)
+		count, err := GetLeadsCount(r.Context(), client, requestWorkspaceID(r), id)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
-		w.WriteHeader(http.StatusNoContent)
-	})
+		json.NewEncoder(w).Encode(count)
+	}))
 
-	// download csv file of leads
+	// get leads count by list id and email_verified = true
 
-	router.GET("/lists/:id/leads/csv", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	router.GET("/lists/:id/leads/count/email_verified", requireScope(ScopeReadLeads, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeError(w, r, invalidID("id"))
 			return
 		}
-		err = DownloadLeadsAsCSV(client, id, w)
+		count, err := CountEmailVerified(r.Context(), client, requestWorkspaceID(r), id)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
-	})
-	// enable cors and content type json from headers for all routes
-	wrappedRouter := enableCORSAndJSONContentType(router)
-	log.Fatal(http.ListenAndServe(":30001", wrappedRouter))
+		json.NewEncoder(w).Encode(count)
+	}))
+
+	// get leads count by list id and email_is_valid = yes
+
+	router.GET("/lists/:id/leads/count/valid_emails", requireScope(ScopeReadLeads, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
+		if err != nil {
+			writeError(w, r, invalidID("id"))
+			return
+		}
+		count, err := CountValidEmails(r.Context(), client, requestWorkspaceID(r), id)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(count)
+	}))
+
+	// get leads count by list id and email_is_valid = no
+
+	router.GET("/lists/:id/leads/count/invalid_emails", requireScope(ScopeReadLeads, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
+		if err != nil {
+			writeError(w, r, invalidID("id"))
+			return
+		}
+		count, err := CountInvalidEmails(r.Context(), client, requestWorkspaceID(r), id)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(count)
+	}))
+
+	// get leads count by list id and email_is_valid = unknown
+
+	router.GET("/lists/:id/leads/count/unknown_emails", requireScope(ScopeReadLeads, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
+		if err != nil {
+			writeError(w, r, invalidID("id"))
+			return
+		}
+		count, err := CountUnknownEmails(r.Context(), client, requestWorkspaceID(r), id)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(count)
+	}))
+
+	// count for all emails no matter the list
+
+	router.GET("/count_all", requireScope(ScopeReadLeads, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		emailIsValid := r.URL.Query().Get("email_is_valid")
+		count, err := CountAllEmails(r.Context(), client, requestWorkspaceID(r), emailIsValid)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(count)
+	}))
+
+	router.POST("/lists/:id/queue", requireScope(ScopeVerify, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
+		if err != nil {
+			writeError(w, r, invalidID("id"))
+			return
+		}
+		// ?mode=unverified_only|stale|all, stale_older_than=<duration> implies mode=stale
+		mode := r.URL.Query().Get("mode")
+		var staleOlderThan time.Duration
+		if raw := r.URL.Query().Get("stale_older_than"); raw != "" {
+			staleOlderThan, err = parseDuration(raw)
+			if err != nil {
+				writeError(w, r, badRequest(err.Error()))
+				return
+			}
+			if mode == "" {
+				mode = EnqueueStale
+			}
+		}
+		switch mode {
+		case "", EnqueueUnverifiedOnly, EnqueueAll:
+		case EnqueueStale:
+			if staleOlderThan <= 0 {
+				writeError(w, r, badRequest("stale_older_than is required for mode=stale"))
+				return
+			}
+		default:
+			writeError(w, r, badRequest("mode must be unverified_only, stale or all"))
+			return
+		}
+		opts := EnqueueOptions{Mode: mode, StaleOlderThan: staleOlderThan}
+		if raw := r.URL.Query().Get("priority"); raw != "" {
+			priority, err := strconv.Atoi(raw)
+			if err != nil {
+				writeError(w, r, badRequest("priority must be an integer"))
+				return
+			}
+			opts.Priority = &priority
+		}
+		queued, suppressed, err := AddListToQueue(r.Context(), client, requestWorkspaceID(r), id, opts)
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, notFound("list not found"))
+			return
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		JsonResponse := struct {
+			Queued     int `json:"queued"`
+			Suppressed int `json:"suppressed"`
+		}{
+			Queued:     queued,
+			Suppressed: suppressed}
+		json.NewEncoder(w).Encode(JsonResponse)
+	}))
+
+	// is list in queue
+
+	router.GET("/lists/:id/queue", requireScope(ScopeReadLists, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
+		if err != nil {
+			writeError(w, r, invalidID("id"))
+			return
+		}
+		inQueue, err := IsListInQueue(r.Context(), client, requestWorkspaceID(r), id)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		paused, err := IsListQueuePaused(r.Context(), client, requestWorkspaceID(r), id)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		state := "idle"
+		if paused {
+			state = "paused"
+		} else if inQueue {
+			state = "queued"
+		}
+		JsonResponse := struct {
+			InQueue bool   `json:"in_queue"`
+			Paused  bool   `json:"paused"`
+			State   string `json:"state"`
+		}{
+			InQueue: inQueue,
+			Paused:  paused,
+			State:   state}
+		json.NewEncoder(w).Encode(JsonResponse)
+	}))
+
+	// pause and resume verification of a list
+
+	router.POST("/lists/:id/queue/pause", requireScope(ScopeVerify, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
+		if err != nil {
+			writeError(w, r, invalidID("id"))
+			return
+		}
+		err = SetListQueuePaused(r.Context(), client, requestWorkspaceID(r), id, true)
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, notFound("list not found"))
+			return
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	router.POST("/lists/:id/queue/resume", requireScope(ScopeVerify, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
+		if err != nil {
+			writeError(w, r, invalidID("id"))
+			return
+		}
+		err = SetListQueuePaused(r.Context(), client, requestWorkspaceID(r), id, false)
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, notFound("list not found"))
+			return
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	// remove list from queue
+
+	router.DELETE("/lists/:id/queue", requireScope(ScopeVerify, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
+		if err != nil {
+			writeError(w, r, invalidID("id"))
+			return
+		}
+		removed, err := RemoveListFromQueue(r.Context(), client, requestWorkspaceID(r), id)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		JsonResponse := struct {
+			Removed int64 `json:"removed"`
+		}{
+			Removed: removed}
+		json.NewEncoder(w).Encode(JsonResponse)
+	}))
+
+	// queue progress overall and per list
+
+	router.GET("/queue", requireScope(ScopeReadLists, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		window, err := throughputWindow(r)
+		if err != nil {
+			writeError(w, r, badRequest(err.Error()))
+			return
+		}
+		status, err := GetQueueStatus(r.Context(), client, requestWorkspaceID(r), nil, window)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		total, err := GetQueueCount(r.Context(), client, requestWorkspaceID(r))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		JsonResponse := struct {
+			Total int64 `json:"total"`
+			QueueStatus
+		}{
+			Total:       total,
+			QueueStatus: status}
+		json.NewEncoder(w).Encode(JsonResponse)
+	}))
+
+	router.GET("/lists/:id/queue/status", requireScope(ScopeReadLists, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
+		if err != nil {
+			writeError(w, r, invalidID("id"))
+			return
+		}
+		window, err := throughputWindow(r)
+		if err != nil {
+			writeError(w, r, badRequest(err.Error()))
+			return
+		}
+		status, err := GetQueueStatus(r.Context(), client, requestWorkspaceID(r), &id, window)
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, notFound("list not found"))
+			return
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(status)
+	}))
+
+	// live verification progress of a list as server-sent events
+
+	router.GET("/lists/:id/events", requireScope(ScopeReadLists, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
+		if err != nil {
+			writeError(w, r, invalidID("id"))
+			return
+		}
+		list, err := GetList(r.Context(), client, requestWorkspaceID(r), id)
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, notFound("list not found"))
+			return
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeError(w, r, errors.New("streaming is not supported"))
+			return
+		}
+		// a reconnecting client continues after the last event it saw
+		after := primitive.NewObjectIDFromTimestamp(time.Now())
+		if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+			after, err = primitive.ObjectIDFromHex(lastEventID)
+			if err != nil {
+				writeError(w, r, invalidID("Last-Event-ID"))
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+
+		// the stream starts with the list's current totals
+		progress := ListProgress{}
+		if list.Progress != nil {
+			progress = *list.Progress
+		}
+		snapshot, err := json.Marshal(struct {
+			ListID   primitive.ObjectID `json:"list_id"`
+			Progress ListProgress       `json:"progress"`
+		}{id, progress})
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(w, "event: progress\ndata: %s\n\n", snapshot)
+		flusher.Flush()
+
+		// streams end on shutdown too, otherwise they would hold it up until its deadline
+		streamCtx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		stopOnShutdown := context.AfterFunc(ctx, cancel)
+		defer stopOnShutdown()
+
+		err = StreamListEvents(streamCtx, client, requestWorkspaceID(r), id, after, func(event ListEvent) error {
+			data, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(w, "id: %s\nevent: verified\ndata: %s\n\n", event.ID.Hex(), data)
+			flusher.Flush()
+			return err
+		}, func() error {
+			_, err := fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+			return err
+		})
+		if err != nil && streamCtx.Err() == nil {
+			loggerFromContext(r.Context()).Error("streaming list events", "list_id", id.Hex(), "error", err)
+		}
+	}))
+
+	router.GET("/processQueue", requireScope(ScopeVerify, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if !worker.startRun() {
+			writeError(w, r, conflict("the queue is already being processed"))
+			return
+		}
+		// the worker outlives the request, so it runs under the server's context,
+		// its logs carry the ID of the request that started it
+		go processQueue(withLogger(ctx, loggerFromContext(r.Context())), client, worker)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	// rate limits for SMTP probing per recipient domain and MX host
+
+	router.GET("/rate_limits", requireScope(ScopeSuperAdmin, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		limits, err := GetRateLimits(r.Context(), client)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		JsonResponse := struct {
+			DefaultDomain RateLimit   `json:"default_domain"`
+			DefaultMX     RateLimit   `json:"default_mx"`
+			Limits        []RateLimit `json:"limits"`
+		}{
+			DefaultDomain: defaultDomainRateLimit,
+			DefaultMX:     defaultMXRateLimit,
+			Limits:        limits}
+		json.NewEncoder(w).Encode(JsonResponse)
+	}))
+
+	router.PUT("/rate_limits/:kind/:host", requireScope(ScopeSuperAdmin, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		var limit RateLimit
+		err := decodeJSONBody(r, &limit)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		limit.Kind = ps.ByName("kind")
+		limit.Host = strings.ToLower(ps.ByName("host"))
+		if limit.Kind != RateLimitDomain && limit.Kind != RateLimitMX {
+			writeError(w, r, badRequest("kind must be domain or mx"))
+			return
+		}
+		if limit.MaxConcurrent < 0 || limit.PerMinute < 0 {
+			writeError(w, r, badRequest("max_concurrent and per_minute must not be negative"))
+			return
+		}
+		err = SetRateLimit(r.Context(), client, limit)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(limit)
+	}))
+
+	router.DELETE("/rate_limits/:kind/:host", requireScope(ScopeSuperAdmin, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		err := DeleteRateLimit(r.Context(), client, ps.ByName("kind"), strings.ToLower(ps.ByName("host")))
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, notFound("rate limit not found"))
+			return
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	// custom disposable and allowlist domains, shared by all workspaces
+
+	router.GET("/domain_lists", requireScope(ScopeSuperAdmin, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		entries, err := GetDomainListEntries(r.Context(), client)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(entries)
+	}))
+
+	router.PUT("/domain_lists/:kind/:domain", requireScope(ScopeSuperAdmin, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		var reqBody struct {
+			Reason string `json:"reason"`
+		}
+		// the body is optional
+		if r.ContentLength != 0 {
+			err := decodeJSONBody(r, &reqBody)
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+		}
+		entry := DomainListEntry{Kind: ps.ByName("kind"), Domain: strings.ToLower(ps.ByName("domain")), Reason: reqBody.Reason, UpdatedAt: time.Now()}
+		if entry.Kind != DomainListDisposable && entry.Kind != DomainListAllowlist {
+			writeError(w, r, badRequest("kind must be disposable or allowlist"))
+			return
+		}
+		if !strings.Contains(entry.Domain, ".") || strings.ContainsAny(entry.Domain, "@*/ ") {
+			writeError(w, r, badRequest(entry.Domain+" is not a domain"))
+			return
+		}
+		err := SetDomainListEntry(r.Context(), client, entry)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(entry)
+	}))
+
+	router.DELETE("/domain_lists/:kind/:domain", requireScope(ScopeSuperAdmin, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		err := DeleteDomainListEntry(r.Context(), client, ps.ByName("kind"), strings.ToLower(ps.ByName("domain")))
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, notFound("domain is not on the "+ps.ByName("kind")+" list"))
+			return
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	// which list decides whether a domain is disposable
+	router.GET("/domains/:domain", requireScope(ScopeReadLists, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		classification, err := ClassifyDomain(r.Context(), client, ps.ByName("domain"))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(classification)
+	}))
+
+	// api key management
+
+	router.POST("/api_keys", requireScope(ScopeAdmin, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		var reqBody struct {
+			Name   string   `json:"name"`
+			Scopes []string `json:"scopes"`
+		}
+		err := decodeJSONBody(r, &reqBody)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if reqBody.Name == "" || len(reqBody.Scopes) == 0 {
+			writeError(w, r, badRequest("name and scopes are required"))
+			return
+		}
+		for _, scope := range reqBody.Scopes {
+			if !slices.Contains(allScopes, scope) {
+				writeError(w, r, badRequest("unknown scope: "+scope))
+				return
+			}
+		}
+		// workspace admins must not be able to hand out access to other workspaces
+		apiKey, _ := apiKeyFromContext(r.Context())
+		if slices.Contains(reqBody.Scopes, ScopeSuperAdmin) && !apiKey.HasScope(ScopeSuperAdmin) {
+			writeError(w, r, forbidden("only superadmin keys can grant the superadmin scope"))
+			return
+		}
+		apiKey, key, err := CreateAPIKey(r.Context(), client, requestWorkspaceID(r), reqBody.Name, reqBody.Scopes)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		// the key itself is only ever returned here
+		JsonResponse := struct {
+			Key    string `json:"key"`
+			APIKey APIKey `json:"api_key"`
+		}{
+			Key:    key,
+			APIKey: apiKey}
+		json.NewEncoder(w).Encode(JsonResponse)
+	}))
+
+	router.GET("/api_keys", requireScope(ScopeAdmin, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		keys, err := GetAPIKeys(r.Context(), client, requestWorkspaceID(r))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(keys)
+	}))
+
+	router.DELETE("/api_keys/:id", requireScope(ScopeAdmin, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
+		if err != nil {
+			writeError(w, r, invalidID("id"))
+			return
+		}
+		err = RevokeAPIKey(r.Context(), client, requestWorkspaceID(r), id)
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, notFound("API key not found"))
+			return
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	// verification credits and usage of the caller's workspace
+
+	router.GET("/usage", requireScope(ScopeReadLists, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		// ?from=YYYY-MM-DD&to=YYYY-MM-DD, the current month by default
+		now := time.Now().UTC()
+		from := startOfMonth(now)
+		to := now
+		var err error
+		if raw := r.URL.Query().Get("from"); raw != "" {
+			from, err = time.Parse(usageDayLayout, raw)
+			if err != nil {
+				writeError(w, r, badRequest("from must be a date like 2006-01-02"))
+				return
+			}
+		}
+		if raw := r.URL.Query().Get("to"); raw != "" {
+			to, err = time.Parse(usageDayLayout, raw)
+			if err != nil {
+				writeError(w, r, badRequest("to must be a date like 2006-01-02"))
+				return
+			}
+		}
+		usage, err := GetUsage(r.Context(), client, requestWorkspaceID(r), from, to)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(usage)
+	}))
+
+	// workspace management
+
+	router.POST("/workspaces", requireScope(ScopeSuperAdmin, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		var reqBody struct {
+			Name string `json:"name"`
+		}
+		err := decodeJSONBody(r, &reqBody)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if reqBody.Name == "" {
+			writeError(w, r, badRequest("name is required"))
+			return
+		}
+		workspace, err := CreateWorkspace(r.Context(), client, reqBody.Name)
+		if mongo.IsDuplicateKeyError(err) {
+			writeError(w, r, conflict("workspace already exists"))
+			return
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		// a new workspace is useless without a key for it
+		apiKey, key, err := CreateAPIKey(r.Context(), client, workspace.ID, "admin", []string{ScopeAdmin})
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		JsonResponse := struct {
+			Workspace Workspace `json:"workspace"`
+			Key       string    `json:"key"`
+			APIKey    APIKey    `json:"api_key"`
+		}{
+			Workspace: workspace,
+			Key:       key,
+			APIKey:    apiKey}
+		json.NewEncoder(w).Encode(JsonResponse)
+	}))
+
+	router.PATCH("/workspaces/:id", requireScope(ScopeSuperAdmin, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
+		if err != nil {
+			writeError(w, r, invalidID("id"))
+			return
+		}
+		var reqBody struct {
+			// a number sets the balance, null makes the credits unlimited
+			Credits      json.RawMessage `json:"credits"`
+			MonthlyQuota *int64          `json:"monthly_quota"`
+		}
+		err = decodeJSONBody(r, &reqBody)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		var credits *int64
+		unlimitedCredits := string(reqBody.Credits) == "null"
+		if len(reqBody.Credits) > 0 && !unlimitedCredits {
+			err = json.Unmarshal(reqBody.Credits, &credits)
+			if err != nil || *credits < 0 {
+				writeError(w, r, badRequest("credits must be a non-negative integer or null"))
+				return
+			}
+		}
+		if reqBody.MonthlyQuota != nil && *reqBody.MonthlyQuota < 0 {
+			writeError(w, r, badRequest("monthly_quota must not be negative"))
+			return
+		}
+		workspace, err := UpdateWorkspaceCredits(r.Context(), client, id, credits, unlimitedCredits, reqBody.MonthlyQuota)
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, notFound("workspace not found"))
+			return
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(workspace)
+	}))
+
+	router.GET("/workspaces", requireScope(ScopeSuperAdmin, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		workspaces, err := GetWorkspaces(r.Context(), client)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(workspaces)
+	}))
+
+	// webhook subscriptions and their delivery log
+
+	router.POST("/webhooks", requireScope(ScopeAdmin, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		var reqBody struct {
+			URL    string   `json:"url"`
+			Events []string `json:"events"`
+		}
+		err := decodeJSONBody(r, &reqBody)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		// CreateWebhook validates the url and events
+		webhook, secret, err := CreateWebhook(r.Context(), client, requestWorkspaceID(r), reqBody.URL, reqBody.Events)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		// the secret is only ever returned here
+		JsonResponse := struct {
+			Secret  string  `json:"secret"`
+			Webhook Webhook `json:"webhook"`
+		}{
+			Secret:  secret,
+			Webhook: webhook}
+		json.NewEncoder(w).Encode(JsonResponse)
+	}))
+
+	router.GET("/webhooks", requireScope(ScopeAdmin, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		webhooks, err := GetWebhooks(r.Context(), client, requestWorkspaceID(r))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(webhooks)
+	}))
+
+	router.DELETE("/webhooks/:id", requireScope(ScopeAdmin, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
+		if err != nil {
+			writeError(w, r, invalidID("id"))
+			return
+		}
+		err = DeleteWebhook(r.Context(), client, requestWorkspaceID(r), id)
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, notFound("webhook not found"))
+			return
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	router.GET("/webhooks/:id/deliveries", requireScope(ScopeAdmin, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
+		if err != nil {
+			writeError(w, r, invalidID("id"))
+			return
+		}
+		// ?status=pending|succeeded|failed&limit=n
+		status := r.URL.Query().Get("status")
+		switch status {
+		case "", DeliveryPending, DeliverySucceeded, DeliveryFailed:
+		default:
+			writeError(w, r, badRequest("status must be pending, succeeded or failed"))
+			return
+		}
+		limit := int64(100)
+		if raw := r.URL.Query().Get("limit"); raw != "" {
+			limit, err = strconv.ParseInt(raw, 10, 64)
+			if err != nil || limit <= 0 {
+				writeError(w, r, badRequest("limit must be a positive integer"))
+				return
+			}
+		}
+		deliveries, err := GetWebhookDeliveries(r.Context(), client, requestWorkspaceID(r), id, status, limit)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(deliveries)
+	}))
+
+	router.POST("/webhooks/:id/deliveries/:delivery_id/replay", requireScope(ScopeAdmin, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		ids, err := parseObjectIDs([]string{ps.ByName("id"), ps.ByName("delivery_id")})
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		delivery, err := ReplayWebhookDelivery(r.Context(), client, requestWorkspaceID(r), ids[0], ids[1])
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, notFound("webhook delivery not found"))
+			return
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(delivery)
+	}))
+
+	// get data from csv file and add to list
+
+	router.POST("/lists/:id/leads/csv", requireScope(ScopeWriteLeads, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
+		if err != nil {
+			writeError(w, r, invalidID("id"))
+			return
+		}
+		imported, err := AddLeadsFromCSV(r.Context(), client, requestWorkspaceID(r), id, r)
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, notFound("list not found"))
+			return
+		}
+		// the event is still emitted when the client went away during the import
+		eventCtx := context.WithoutCancel(r.Context())
+		if err != nil {
+			emitErr := emitEvent(eventCtx, client, requestWorkspaceID(r), EventImportFailed, struct {
+				ListID primitive.ObjectID `json:"list_id"`
+				Error  string             `json:"error"`
+			}{id, err.Error()})
+			if emitErr != nil {
+				loggerFromContext(r.Context()).Error("emitting webhook event", "event", EventImportFailed, "list_id", id.Hex(), "error", emitErr)
+			}
+			writeError(w, r, err)
+			return
+		}
+		err = emitEvent(eventCtx, client, requestWorkspaceID(r), EventImportCompleted, struct {
+			ListID   primitive.ObjectID `json:"list_id"`
+			Imported int                `json:"imported"`
+		}{id, imported})
+		if err != nil {
+			loggerFromContext(r.Context()).Error("emitting webhook event", "event", EventImportCompleted, "list_id", id.Hex(), "error", err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	// download csv file of leads
+
+	router.GET("/lists/:id/leads/csv", requireScope(ScopeReadLeads, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
+		if err != nil {
+			writeError(w, r, invalidID("id"))
+			return
+		}
+		// ?include_suppressed=true exports the leads matching the suppression list as well
+		includeSuppressed := r.URL.Query().Get("include_suppressed") == "true"
+		err = DownloadLeadsAsCSV(r.Context(), client, requestWorkspaceID(r), id, includeSuppressed, w)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}))
+
+	// suppression list routes
+
+	router.GET("/suppressions", requireScope(ScopeReadLeads, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		suppressions, err := GetSuppressions(r.Context(), client, requestWorkspaceID(r))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(suppressions)
+	}))
+
+	router.POST("/suppressions", requireScope(ScopeWriteLeads, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		var reqBody struct {
+			Value  string `json:"value"`
+			Reason string `json:"reason"`
+		}
+		err := decodeJSONBody(r, &reqBody)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		suppression, err := CreateSuppression(r.Context(), client, requestWorkspaceID(r), reqBody.Value, reqBody.Reason)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(suppression)
+	}))
+
+	router.POST("/suppressions/csv", requireScope(ScopeWriteLeads, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		added, err := AddSuppressionsFromCSV(r.Context(), client, requestWorkspaceID(r), r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		JsonResponse := struct {
+			Added int `json:"added"`
+		}{
+			Added: added}
+		json.NewEncoder(w).Encode(JsonResponse)
+	}))
+
+	// lifting a suppression such as a legal opt-out is left to admins
+	router.DELETE("/suppressions/:id", requireScope(ScopeAdmin, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
+		if err != nil {
+			writeError(w, r, invalidID("id"))
+			return
+		}
+		err = DeleteSuppression(r.Context(), client, requestWorkspaceID(r), id)
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, notFound("suppression not found"))
+			return
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	// require an api key, enable cors and content type json from headers for all routes
+	wrappedRouter := logRequests(instrumentRequests(router, enableCORSAndJSONContentType(authenticate(client, router))))
+	// metrics and probes are served without an api key
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(newMetricsRegistry(client), promhttp.HandlerOpts{}))
+	mux.HandleFunc("/healthz", healthz)
+	mux.HandleFunc("/readyz", readyz(ctx, client, worker))
+	mux.Handle("/", wrappedRouter)
+	server := &http.Server{Addr: config.ListenAddr, Handler: mux}
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			fatal("serving HTTP", err)
+		}
+	}()
+	slog.Info("listening", "addr", config.ListenAddr)
+
+	<-ctx.Done()
+	stop()
+	slog.Info("shutting down")
+
+	// one deadline covers both draining requests and in-flight verifications
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	err = server.Shutdown(shutdownCtx)
+	if err != nil {
+		slog.Error("shutting down the HTTP server", "error", err)
+	}
+	worker.drain(shutdownCtx, client)
+	slog.Info("shutdown complete")
 }
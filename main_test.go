@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    time.Duration
+		wantErr bool
+	}{
+		{raw: "15m", want: 15 * time.Minute},
+		{raw: "1h30m", want: 90 * time.Minute},
+		{raw: "7d", want: 7 * 24 * time.Hour},
+		{raw: "0d", want: 0},
+		{raw: "d", wantErr: true},
+		{raw: "1.5d", wantErr: true},
+		{raw: "soon", wantErr: true},
+		{raw: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseDuration(tt.raw)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseDuration(%q) = %v, %v; want %v, error %v", tt.raw, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	emailVerifier "github.com/AfterShip/email-verifier"
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "email_verify_http_requests_total",
+		Help: "HTTP requests by method, route and status code.",
+	}, []string{"method", "route", "status"})
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "email_verify_http_request_duration_seconds",
+		Help:    "HTTP request latency by method and route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+	verifications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "email_verify_verifications_total",
+		Help: "Completed verifications by reachable outcome.",
+	}, []string{"reachable"})
+	verificationDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "email_verify_verification_duration_seconds",
+		Help:    "Time taken to verify one email address.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60, 120},
+	})
+	smtpErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "email_verify_smtp_errors_total",
+		Help: "Verification errors by class.",
+	}, []string{"class"})
+	workersInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "email_verify_workers_in_flight",
+		Help: "Verifications currently running.",
+	})
+	csvImportRows = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "email_verify_csv_import_rows_total",
+		Help: "Leads imported from CSV uploads.",
+	})
+)
+
+// smtpErrorClasses maps the errors of the verifier to metric labels
+var smtpErrorClasses = map[string]string{
+	emailVerifier.ErrTimeout:                 "timeout",
+	emailVerifier.ErrNoSuchHost:              "no_such_host",
+	emailVerifier.ErrServerUnavailable:       "server_unavailable",
+	emailVerifier.ErrBlocked:                 "blocked",
+	emailVerifier.ErrTryAgainLater:           "try_again_later",
+	emailVerifier.ErrFullInbox:               "full_inbox",
+	emailVerifier.ErrTooManyRCPT:             "too_many_rcpt",
+	emailVerifier.ErrNoRelay:                 "no_relay",
+	emailVerifier.ErrMailboxBusy:             "mailbox_busy",
+	emailVerifier.ErrExceededMessagingLimits: "exceeded_messaging_limits",
+	emailVerifier.ErrNotAllowed:              "not_allowed",
+	emailVerifier.ErrNeedMAILBeforeRCPT:      "need_mail_before_rcpt",
+	emailVerifier.ErrRCPTHasMoved:            "rcpt_has_moved",
+}
+
+// smtpErrorClass returns the metric label for a verification error
+func smtpErrorClass(err error) string {
+	var lookupErr *emailVerifier.LookupError
+	if errors.As(err, &lookupErr) {
+		if class, ok := smtpErrorClasses[lookupErr.Message]; ok {
+			return class
+		}
+	}
+	return "other"
+}
+
+// queueDepthCollector reports the number of queue items by status when scraped
+type queueDepthCollector struct {
+	client *mongo.Client
+	desc   *prometheus.Desc
+}
+
+func newQueueDepthCollector(client *mongo.Client) *queueDepthCollector {
+	return &queueDepthCollector{
+		client: client,
+		desc:   prometheus.NewDesc("email_verify_queue_depth", "Queue items by status.", []string{"status"}, nil),
+	}
+}
+
+func (c *queueDepthCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *queueDepthCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.QueryTimeout)
+	defer cancel()
+
+	collection := c.client.Database(config.Database).Collection("verification_queue")
+	for _, status := range []string{QueueStatusPending, QueueStatusInFlight} {
+		count, err := collection.CountDocuments(ctx, bson.M{"status": status})
+		if err != nil {
+			ch <- prometheus.NewInvalidMetric(c.desc, err)
+			return
+		}
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(count), status)
+	}
+}
+
+// newMetricsRegistry registers the service's metrics along with the Go runtime and process metrics
+func newMetricsRegistry(client *mongo.Client) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests,
+		httpRequestDuration,
+		verifications,
+		verificationDuration,
+		smtpErrors,
+		workersInFlight,
+		csvImportRows,
+		newQueueDepthCollector(client),
+	)
+	return registry
+}
+
+// statusRecorder remembers the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush keeps the event stream working through the recorder
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// routePattern returns the route that matches the request, such as "/lists/:id", so
+// that requests for different ids are counted together
+func routePattern(router *httprouter.Router, r *http.Request) string {
+	handle, params, _ := router.Lookup(r.Method, r.URL.Path)
+	if handle == nil {
+		return "unmatched"
+	}
+	segments := strings.Split(r.URL.Path, "/")
+	i := 0
+	for j, segment := range segments {
+		if i < len(params) && segment == params[i].Value {
+			segments[j] = ":" + params[i].Key
+			i++
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// instrumentRequests counts the requests handled by next and measures their latency per route
+func instrumentRequests(router *httprouter.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		route := routePattern(router, r)
+		httpRequests.WithLabelValues(r.Method, route, strconv.Itoa(recorder.status)).Inc()
+		httpRequestDuration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestRoutePattern(t *testing.T) {
+	handle := func(http.ResponseWriter, *http.Request, httprouter.Params) {}
+	router := httprouter.New()
+	router.GET("/lists", handle)
+	router.GET("/lists/:id", handle)
+	router.GET("/lists/:id/leads/csv", handle)
+	router.POST("/webhooks/:id/deliveries/:delivery_id/replay", handle)
+	router.GET("/domain_lists/:kind/:domain", handle)
+
+	tests := []struct {
+		method string
+		path   string
+		want   string
+	}{
+		{http.MethodGet, "/lists", "/lists"},
+		{http.MethodGet, "/lists/665f1c2e8b3e4a0012345678", "/lists/:id"},
+		{http.MethodGet, "/lists/665f1c2e8b3e4a0012345678/leads/csv", "/lists/:id/leads/csv"},
+		{http.MethodPost, "/webhooks/665f1c2e8b3e4a0012345678/deliveries/665f1c2e8b3e4a0012345679/replay", "/webhooks/:id/deliveries/:delivery_id/replay"},
+		// a parameter that looks like a static segment is still a parameter
+		{http.MethodGet, "/domain_lists/disposable/lists", "/domain_lists/:kind/:domain"},
+		{http.MethodGet, "/nothing/here", "unmatched"},
+		{http.MethodDelete, "/lists", "unmatched"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		if got := routePattern(router, r); got != tt.want {
+			t.Errorf("routePattern(%s %s) = %q, want %q", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
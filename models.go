@@ -1,27 +1,66 @@
 package main
 
 import (
+	"time"
+
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type List struct {
-	ID   primitive.ObjectID `bson:"_id,omitempty"`
-	Name string             `bson:"name"`
+	ID            primitive.ObjectID `bson:"_id,omitempty"`
+	WorkspaceID   primitive.ObjectID `bson:"workspace_id"`
+	Name          string             `bson:"name"`
+	Metadata      any                `bson:"metadata,omitempty"`
+	QueuePaused   bool               `bson:"queue_paused"`
+	QueuePriority int                `bson:"queue_priority"` // default priority of the list's queue items, higher is verified first
+	DeletedAt     *time.Time         `bson:"deleted_at,omitempty"`
+	Progress      *ListProgress      `bson:"progress,omitempty"`
+	Merge         *ListMerge         `bson:"merge,omitempty"` // set while the list is being merged into another one
+	// when the list's latest round of verification started, see markListVerificationPending
+	VerificationStartedAt *time.Time `bson:"verification_started_at,omitempty"`
+}
+
+// ListMerge tracks a merge of the list into another one so an interrupted merge can be resumed
+type ListMerge struct {
+	TargetListID primitive.ObjectID `bson:"target_list_id"`
+	Moved        int                `bson:"moved"`
+	Merged       int                `bson:"merged"`
 }
 
 type Lead struct {
 	ID                 primitive.ObjectID `bson:"_id,omitempty"`
+	WorkspaceID        primitive.ObjectID `bson:"workspace_id"`
 	Email              string             `bson:"email"`
 	ListID             primitive.ObjectID `bson:"list_id"`
 	LeadData           any                `bson:"lead_data"`
 	EmailVerified      bool               `bson:"email_verified"`
 	EmailIsValid       string             `bson:"email_is_valid"`
 	VerificationResult any                `bson:"verification_result"`
+	VerifiedAt         *time.Time         `bson:"verified_at,omitempty"`
+	VerificationError  string             `bson:"verification_error,omitempty"`
+	// set when the lead was skipped for matching the suppression list
+	Suppressed bool `bson:"suppressed,omitempty"`
+}
+
+// LeadFilter selects leads of a list by their verification state
+type LeadFilter struct {
+	EmailVerified *bool   `json:"email_verified"`
+	EmailIsValid  *string `json:"email_is_valid"`
 }
 
 type VerificationQueue struct {
-	ID     primitive.ObjectID `bson:"_id,omitempty"`
-	Email  string             `bson:"email"`
-	LeadID primitive.ObjectID `bson:"lead_id"`
-	ListID primitive.ObjectID `bson:"list_id"`
+	ID          primitive.ObjectID `bson:"_id,omitempty"`
+	WorkspaceID primitive.ObjectID `bson:"workspace_id"`
+	Email       string             `bson:"email"`
+	Domain      string             `bson:"domain"`
+	LeadID      primitive.ObjectID `bson:"lead_id"`
+	ListID      primitive.ObjectID `bson:"list_id"`
+	Priority    int                `bson:"priority"`
+	EnqueuedAt  time.Time          `bson:"enqueued_at"`
+	// the worker picks items in order of position, see queuePosition
+	Position  time.Time  `bson:"position"`
+	Status    string     `bson:"status"`
+	ClaimedAt *time.Time `bson:"claimed_at,omitempty"`
+	// whether a credit was reserved for the item when it was queued
+	Reserved bool `bson:"reserved,omitempty"`
 }
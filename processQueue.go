@@ -1,55 +1,448 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"log/slog"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	emailVerifier "github.com/AfterShip/email-verifier"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
-func processQueue(client *mongo.Client) {
-	log.Println("Processing queue")
-	queue, err := GetQueue(client)
+// how long the worker waits for a rate limited domain to free up before looking at the queue again
+const rateLimitPollInterval = time.Second
+
+// queue items claimed longer ago than this are assumed to belong to a worker that died
+const staleClaimTimeout = 15 * time.Minute
+
+// queueWorker keeps track of the verifications started by processQueue runs so that
+// shutdown can wait for them and hand unfinished items back to the queue
+type queueWorker struct {
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	claimed map[primitive.ObjectID]bool
+	// set while a processQueue run is in progress, only one runs at a time
+	running atomic.Bool
+}
+
+// status reports whether the worker is processing the queue and how many verifications are running
+func (qw *queueWorker) status() (running bool, inFlight int) {
+	qw.mu.Lock()
+	inFlight = len(qw.claimed)
+	qw.mu.Unlock()
+	return qw.running.Load(), inFlight
+}
+
+// startRun reserves the worker for a processQueue run. It returns false when a run is
+// already in progress.
+func (qw *queueWorker) startRun() bool {
+	return qw.running.CompareAndSwap(false, true)
+}
+
+func newQueueWorker() *queueWorker {
+	return &queueWorker{claimed: make(map[primitive.ObjectID]bool)}
+}
+
+func (qw *queueWorker) track(id primitive.ObjectID) {
+	qw.mu.Lock()
+	qw.claimed[id] = true
+	qw.mu.Unlock()
+	qw.wg.Add(1)
+}
+
+func (qw *queueWorker) done(id primitive.ObjectID) {
+	qw.mu.Lock()
+	delete(qw.claimed, id)
+	qw.mu.Unlock()
+	qw.wg.Done()
+}
+
+// drain waits for the running verifications until ctx expires, then releases the items
+// that are still running back to the queue so another worker picks them up
+func (qw *queueWorker) drain(ctx context.Context, client *mongo.Client) {
+	finished := make(chan struct{})
+	go func() {
+		qw.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return
+	case <-ctx.Done():
+	}
+
+	qw.mu.Lock()
+	unfinished := make([]primitive.ObjectID, 0, len(qw.claimed))
+	for id := range qw.claimed {
+		unfinished = append(unfinished, id)
+	}
+	qw.mu.Unlock()
+
+	slog.Warn("releasing unfinished queue items", "count", len(unfinished))
+	releaseCtx, cancel := context.WithTimeout(context.Background(), config.QueryTimeout)
+	defer cancel()
+	for _, id := range unfinished {
+		err := ReleaseQueueItem(releaseCtx, client, id)
+		if err != nil {
+			slog.Error("releasing queue item", "queue_item_id", id.Hex(), "error", err)
+		}
+	}
+}
+
+// processQueue verifies queue items until the queue is empty or ctx is cancelled.
+// Cancelling ctx only stops new items from being claimed, verifications that already
+// started run to completion and are tracked by qw. The caller reserves the run with
+// qw.startRun, processQueue ends it.
+func processQueue(ctx context.Context, client *mongo.Client, qw *queueWorker) {
+	defer qw.running.Store(false)
+	// every line logged by this run and its verifications carries the run's ID
+	logger := loggerFromContext(ctx).With("run_id", newCorrelationID())
+	ctx = withLogger(ctx, logger)
+	logger.Info("processing queue")
+
+	released, err := ReleaseStaleClaims(ctx, client, staleClaimTimeout)
+	if err != nil {
+		logger.Error("releasing stale claims", "error", err)
+		return
+	}
+	if released > 0 {
+		logger.Warn("released stale queue claims", "count", released)
+	}
+
+	rateLimits, err := GetRateLimits(ctx, client)
 	if err != nil {
-		log.Println(err)
+		logger.Error("loading rate limits", "error", err)
 		return
 	}
+	// limits changed since the last run apply from now on
+	probeLimiter.setLimits(rateLimits)
+	limiter := probeLimiter
+
+	// the custom disposable and allowlist domains override the verifier's list for the whole run
+	overrides, err := loadDomainOverrides(ctx, client)
+	if err != nil {
+		logger.Error("loading domain lists", "error", err)
+		return
+	}
+
+	verifier := sharedVerifier()
+
+	// verifications keep going during shutdown, so they must not inherit its cancellation
+	verifyCtx := context.WithoutCancel(ctx)
 
 	// Limit the number of concurrent goroutines
-	const maxConcurrency = 10
-	semaphore := make(chan struct{}, maxConcurrency)
+	semaphore := make(chan struct{}, config.WorkerConcurrency)
 
 	var wg sync.WaitGroup
-	for _, q := range queue {
-		semaphore <- struct{}{} // Acquire a token
-		wg.Add(1)
-		go func(q VerificationQueue) {
-			defer wg.Done()
-			defer func() { <-semaphore }() // Release the token
-
-			lead, err := GetLead(client, q.LeadID)
-			if err != nil {
-				log.Println(err)
+	var running atomic.Int64
+	for ctx.Err() == nil {
+		// leave saturated domains in the queue so the batch is filled with domains we can probe now
+		blocked := limiter.blockedDomains()
+		// the queue is fetched in small batches so that higher priority items queued
+		// while the worker is running are picked up quickly
+		queue, err := GetQueue(ctx, client, blocked, int64(config.QueueBatchSize))
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.Error("fetching queue", "error", err)
+			}
+			break
+		}
+		if len(queue) == 0 {
+			if running.Load() == 0 && len(blocked) == 0 {
+				break
 			}
+			// the remaining items are running or waiting on a rate limit
+			limiter.wait(ctx, rateLimitPollInterval)
+			continue
+		}
 
-			verifier := emailVerifier.NewVerifier().EnableSMTPCheck().EnableAutoUpdateDisposable().EnableCatchAllCheck().EnableDomainSuggest().EnableGravatarCheck().HelloName("mx.google.com").FromEmail("vivek@thinksurfmedia.info")
-			ret, err := verifier.Verify(lead.Email)
-			if err != nil {
-				log.Println(err)
+		domains := make([]string, len(queue))
+		for i, q := range queue {
+			domains[i] = q.Domain
+			if domains[i] == "" {
+				domains[i] = emailDomain(q.Email)
 			}
+		}
+		limiter.resolveDomains(ctx, domains)
 
-			bytes, err := json.Marshal(ret)
-			if err != nil {
-				log.Println(err)
+		dispatched := 0
+		for i, q := range queue {
+			keys := limiter.keys(ctx, domains[i])
+			if !limiter.tryAcquire(keys) {
+				continue
 			}
-			reason := bson.M{"reachable": ret.Reachable, "reason": string(bytes)}
-			err = Dequeue(client, q.ID, ret.Reachable, reason)
-			if err != nil {
-				log.Println(err)
+
+			// Acquire a token, unless we are shutting down
+			select {
+			case semaphore <- struct{}{}:
+			case <-ctx.Done():
+			}
+			if ctx.Err() != nil {
+				limiter.release(keys)
+				break
 			}
-		}(q)
+			claimed, err := ClaimQueueItem(ctx, client, q.ID)
+			if err != nil || !claimed {
+				if err != nil {
+					logger.Error("claiming queue item", "queue_item_id", q.ID.Hex(), "error", err)
+				}
+				limiter.release(keys)
+				<-semaphore
+				continue
+			}
+			dispatched++
+
+			running.Add(1)
+			workersInFlight.Inc()
+			wg.Add(1)
+			qw.track(q.ID)
+			go func(q VerificationQueue) {
+				defer wg.Done()
+				defer func() {
+					limiter.release(keys)
+					running.Add(-1)
+					workersInFlight.Dec()
+					qw.done(q.ID)
+					<-semaphore // Release the token
+				}()
+				verifyQueueItem(verifyCtx, client, verifier, overrides, q)
+			}(q)
+		}
+		if dispatched == 0 {
+			limiter.wait(ctx, rateLimitPollInterval)
+		}
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		logger.Info("queue processing stopped")
+		return
+	}
+	logger.Info("queue processed")
+}
+
+func verifyQueueItem(ctx context.Context, client *mongo.Client, verifier *emailVerifier.Verifier, overrides domainOverrides, q VerificationQueue) {
+	logger := loggerFromContext(ctx).With(
+		"queue_item_id", q.ID.Hex(),
+		"lead_id", q.LeadID.Hex(),
+		"list_id", q.ListID.Hex(),
+		"workspace_id", q.WorkspaceID.Hex(),
+	)
+	ctx = withLogger(ctx, logger)
+
+	// the list may have been paused after the queue was fetched
+	paused, err := IsListQueuePaused(ctx, client, q.WorkspaceID, q.ListID)
+	if err != nil {
+		logger.Error("checking whether the list is paused", "error", err)
+		err = ReleaseQueueItem(ctx, client, q.ID)
+		if err != nil {
+			logger.Error("releasing queue item", "error", err)
+		}
+		return
+	}
+	if paused {
+		logger.Debug("list is paused, releasing queue item")
+		err = ReleaseQueueItem(ctx, client, q.ID)
+		if err != nil {
+			logger.Error("releasing queue item", "error", err)
+		}
+		return
+	}
+
+	lead, err := GetLead(ctx, client, q.WorkspaceID, q.LeadID)
+	// the lead was deleted or trashed after the queue was fetched
+	if err == mongo.ErrNoDocuments {
+		logger.Info("lead is gone, dropping queue item")
+		_, err = DropQueueItem(ctx, client, q)
+		if err != nil {
+			logger.Error("dropping queue item", "error", err)
+		}
+		return
+	}
+	if err != nil {
+		logger.Error("loading lead", "error", err)
+		err = ReleaseQueueItem(ctx, client, q.ID)
+		if err != nil {
+			logger.Error("releasing queue item", "error", err)
+		}
+		return
+	}
+
+	// the suppression list may have grown since the lead was queued
+	suppressed, err := IsSuppressed(ctx, client, q.WorkspaceID, lead.Email)
+	if err != nil {
+		logger.Error("checking the suppression list", "error", err)
+		err = ReleaseQueueItem(ctx, client, q.ID)
+		if err != nil {
+			logger.Error("releasing queue item", "error", err)
+		}
+		return
+	}
+	if suppressed {
+		logger.Info("lead is suppressed, dropping queue item")
+		progress, err := DropSuppressedQueueItem(ctx, client, q)
+		if err != nil {
+			logger.Error("dropping queue item", "error", err)
+			return
+		}
+		notifyVerified(ctx, client, q, LeadSuppressed, "", progress)
+		return
+	}
+
+	ret, reason, verificationError := verifyEmail(ctx, verifier, lead.Email, overrides[emailDomain(lead.Email)])
+	progress, err := Dequeue(ctx, client, q.ID, ret.Reachable, reason, verificationError)
+	if err == mongo.ErrNoDocuments {
+		// the item was removed during the probe and its credit refunded, but the probe was made
+		logger.Info("queue item is gone, discarding verification result")
+		err = chargeVerification(ctx, client, q.WorkspaceID)
+		if err != nil {
+			logger.Error("charging verification", "error", err)
+		}
+		return
+	}
+	if err != nil {
+		logger.Error("storing verification result", "error", err)
+		return
+	}
+	verifications.WithLabelValues(ret.Reachable).Inc()
+	notifyVerified(ctx, client, q, ret.Reachable, verificationError, progress)
+}
+
+// newVerifier returns a verifier running every check, probing with the configured SMTP identity
+func newVerifier() *emailVerifier.Verifier {
+	return emailVerifier.NewVerifier().EnableSMTPCheck().EnableCatchAllCheck().EnableDomainSuggest().EnableGravatarCheck().HelloName(config.SMTPHelloName).FromEmail(config.SMTPFromEmail)
+}
+
+// sharedVerifier is the verifier of the worker, synchronous verifications and domain
+// classification, so they all see the same disposable domain list. The list is fetched
+// from upstream on first use and updated daily.
+var sharedVerifier = sync.OnceValue(func() *emailVerifier.Verifier {
+	return newVerifier().EnableAutoUpdateDisposable()
+})
+
+// verifyEmail verifies email, with the disposable verdict of the custom domain list named by
+// override if any, and returns the result along with the form it is stored in and the
+// verification error, if any. The result is never nil.
+func verifyEmail(ctx context.Context, verifier *emailVerifier.Verifier, email string, override string) (*emailVerifier.Result, bson.M, string) {
+	logger := loggerFromContext(ctx)
+	verificationError := ""
+	start := time.Now()
+	ret, err := verifyWithOverride(verifier, email, override)
+	duration := time.Since(start)
+	verificationDuration.Observe(duration.Seconds())
+	if err != nil {
+		logger.Warn("verification failed", "error", err, "class", smtpErrorClass(err), "duration_ms", duration.Milliseconds())
+		verificationError = err.Error()
+		smtpErrors.WithLabelValues(smtpErrorClass(err)).Inc()
+	}
+
+	bytes, err := json.Marshal(ret)
+	if err != nil {
+		logger.Error("encoding verification result", "error", err)
+	}
+	logger.Debug("email verified", "reachable", ret.Reachable, "duration_ms", duration.Milliseconds())
+	return ret, bson.M{"reachable": ret.Reachable, "reason": string(bytes)}, verificationError
+}
+
+// VerifyLeadNow verifies a lead inline instead of through the queue, stores and charges the
+// result like the worker does and returns the updated lead. Suppressed leads are only marked.
+func VerifyLeadNow(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, lead Lead) (Lead, error) {
+	suppressed, err := IsSuppressed(ctx, client, workspaceID, lead.Email)
+	if err != nil {
+		return Lead{}, err
+	}
+	if suppressed {
+		lead.Suppressed = true
+		return lead, markLeadsSuppressed(ctx, client, workspaceID, []primitive.ObjectID{lead.ID}, true)
+	}
+	override, err := domainOverride(ctx, client, emailDomain(lead.Email))
+	if err != nil {
+		return Lead{}, err
+	}
+	err = reserveCredits(ctx, client, workspaceID, 1)
+	if err != nil {
+		return Lead{}, err
+	}
+	// the probe counts against the same rate limits as the worker's
+	keys := probeLimiter.keys(ctx, emailDomain(lead.Email))
+	err = probeLimiter.acquire(ctx, keys)
+	if err != nil {
+		return Lead{}, errors.Join(err, refundCredits(context.WithoutCancel(ctx), client, workspaceID, 1))
+	}
+	ret, reason, verificationError := verifyEmail(ctx, sharedVerifier(), lead.Email, override)
+	probeLimiter.release(keys)
+	// the probe was made, so its result is kept even when the client went away meanwhile
+	ctx = context.WithoutCancel(ctx)
+	lead, err = SetLeadVerification(ctx, client, workspaceID, lead.ID, ret.Reachable, reason, verificationError)
+	if err != nil {
+		return Lead{}, err
+	}
+	verifications.WithLabelValues(ret.Reachable).Inc()
+
+	err = emitEvent(ctx, client, workspaceID, EventLeadVerified, leadVerifiedData{lead.ID, lead.ListID, lead.Email, ret.Reachable, verificationError})
+	if err != nil {
+		loggerFromContext(ctx).Error("emitting webhook event", "event", EventLeadVerified, "error", err)
+	}
+	return lead, nil
+}
+
+// leadVerifiedData is the data of the lead.verified webhook event
+type leadVerifiedData struct {
+	LeadID            primitive.ObjectID `json:"lead_id"`
+	ListID            primitive.ObjectID `json:"list_id"`
+	Email             string             `json:"email"`
+	EmailIsValid      string             `json:"email_is_valid"`
+	VerificationError string             `json:"verification_error,omitempty"`
+}
+
+// notifyVerified publishes the list event and emits the webhook events for a verified queue item
+func notifyVerified(ctx context.Context, client *mongo.Client, q VerificationQueue, emailIsValid string, verificationError string, progress ListProgress) {
+	logger := loggerFromContext(ctx)
+	completed, err := completeListVerification(ctx, client, q.WorkspaceID, q.ListID)
+	if err != nil {
+		logger.Error("checking list completion", "error", err)
+	}
+
+	err = publishListEvent(ctx, client, ListEvent{
+		ID:                primitive.NewObjectID(),
+		WorkspaceID:       q.WorkspaceID,
+		ListID:            q.ListID,
+		LeadID:            q.LeadID,
+		Email:             q.Email,
+		EmailIsValid:      emailIsValid,
+		VerificationError: verificationError,
+		Progress:          progress,
+		Completed:         completed,
+		CreatedAt:         time.Now(),
+	})
+	if err != nil {
+		logger.Error("publishing list event", "error", err)
+	}
+
+	// suppressed leads were not verified
+	if emailIsValid != LeadSuppressed {
+		err = emitEvent(ctx, client, q.WorkspaceID, EventLeadVerified, leadVerifiedData{q.LeadID, q.ListID, q.Email, emailIsValid, verificationError})
+		if err != nil {
+			logger.Error("emitting webhook event", "event", EventLeadVerified, "error", err)
+		}
+	}
+
+	if !completed {
+		return
+	}
+	logger.Info("list verification completed")
+	summary, err := GetListVerificationSummary(ctx, client, q.WorkspaceID, q.ListID)
+	if err != nil {
+		logger.Error("summarizing list", "error", err)
+		return
+	}
+	err = emitEvent(ctx, client, q.WorkspaceID, EventListVerificationCompleted, summary)
+	if err != nil {
+		logger.Error("emitting webhook event", "event", EventListVerificationCompleted, "error", err)
 	}
 }
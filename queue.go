@@ -2,42 +2,278 @@ package main
 
 import (
 	"context"
+	"errors"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-func AddListToQueue(client *mongo.Client, listID primitive.ObjectID) error {
-	// get all leads in the list and add them to the queue only if they are not already in the queue
-	collection := client.Database("email_verify").Collection("leads")
-	// add leads concurrently to make it faster
-	cursor, err := collection.Find(context.TODO(), bson.M{"list_id": listID})
+// enqueue modes for AddListToQueue
+const (
+	EnqueueUnverifiedOnly = "unverified_only"
+	EnqueueStale          = "stale"
+	EnqueueAll            = "all"
+)
+
+// stands in for the verification result in the list events of suppressed leads
+const LeadSuppressed = "suppressed"
+
+// ways POST /leads can verify the lead it creates
+const (
+	VerifyQueue = "queue"
+	VerifySync  = "sync"
+)
+
+// states of a queue item
+const (
+	QueueStatusPending  = "pending"
+	QueueStatusInFlight = "in_flight"
+)
+
+// every queuePriorityAging an item spends waiting in the queue counts as one extra
+// priority level, so low priority items still make progress behind a busy lane
+const queuePriorityAging = 10 * time.Minute
+
+// queuePosition is the time an item would have been enqueued at with priority 0 to end up
+// at the same place in the queue: each priority level moves it queuePriorityAging ahead.
+// Ordering by position is ordering by priority plus the levels gained by waiting, and as
+// the position never changes it can be indexed.
+func queuePosition(enqueuedAt time.Time, priority int) time.Time {
+	return enqueuedAt.Add(-time.Duration(priority) * queuePriorityAging)
+}
+
+// EnqueueOptions controls which leads AddListToQueue picks and how they are queued
+type EnqueueOptions struct {
+	// Mode is one of EnqueueUnverifiedOnly (the default), EnqueueStale or EnqueueAll
+	Mode string
+	// StaleOlderThan is the age after which a verification is considered stale in EnqueueStale mode
+	StaleOlderThan time.Duration
+	// Priority overrides the list's queue priority when set
+	Priority *int
+}
+
+// AddListToQueue queues the leads of the list picked by opts.Mode and returns how many were
+// queued and how many were suppressed. unverified_only queues leads that were never verified,
+// stale also re-queues leads whose verification is older than opts.StaleOlderThan, and all
+// queues every lead. Leads that are already in the queue are skipped, and so are leads
+// matching the suppression list, which are marked suppressed instead.
+func AddListToQueue(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, listID primitive.ObjectID, opts EnqueueOptions) (int, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.BulkTimeout)
+	defer cancel()
+
+	list, err := GetList(ctx, client, workspaceID, listID)
 	if err != nil {
-		return err
+		return 0, 0, err
+	}
+	priority := list.QueuePriority
+	if opts.Priority != nil {
+		priority = *opts.Priority
 	}
-	defer cursor.Close(context.TODO())
 
-	queueCollection := client.Database("email_verify").Collection("verification_queue")
-	var queue []VerificationQueue
-	for cursor.Next(context.Background()) {
+	filter := bson.M{"list_id": listID, "workspace_id": workspaceID}
+	switch opts.Mode {
+	case "", EnqueueUnverifiedOnly:
+		filter["email_verified"] = bson.M{"$ne": true}
+	case EnqueueStale:
+		filter["$or"] = bson.A{
+			bson.M{"email_verified": bson.M{"$ne": true}},
+			bson.M{"verified_at": bson.M{"$exists": false}},
+			bson.M{"verified_at": bson.M{"$lt": time.Now().Add(-opts.StaleOlderThan)}},
+		}
+	case EnqueueAll:
+	default:
+		return 0, 0, errors.New("unknown enqueue mode: " + opts.Mode)
+	}
+
+	queueCollection := client.Database(config.Database).Collection("verification_queue")
+	queued, err := queuedLeadIDs(ctx, client, workspaceID, listID)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	collection := client.Database(config.Database).Collection("leads")
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	suppressions, err := loadSuppressions(ctx, client, workspaceID)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	now := time.Now()
+	var queueDocuments []interface{}
+	var suppressedIDs, unsuppressedIDs []primitive.ObjectID
+	for cursor.Next(ctx) {
 		var lead Lead
 		cursor.Decode(&lead)
-		queue = append(queue, VerificationQueue{Email: lead.Email, LeadID: lead.ID, ListID: lead.ListID})
+		if suppressions.matches(lead.Email) {
+			suppressedIDs = append(suppressedIDs, lead.ID)
+			continue
+		}
+		// the entry that suppressed it was removed since
+		if lead.Suppressed {
+			unsuppressedIDs = append(unsuppressedIDs, lead.ID)
+		}
+		if queued[lead.ID] {
+			continue
+		}
+		queueDocuments = append(queueDocuments, VerificationQueue{WorkspaceID: workspaceID, Email: lead.Email, Domain: emailDomain(lead.Email), LeadID: lead.ID, ListID: lead.ListID, Priority: priority, EnqueuedAt: now, Position: queuePosition(now, priority), Status: QueueStatusPending, Reserved: true})
+	}
+	if err := cursor.Err(); err != nil {
+		return 0, 0, err
+	}
+	err = markLeadsSuppressed(ctx, client, workspaceID, suppressedIDs, true)
+	if err != nil {
+		return 0, 0, err
+	}
+	err = markLeadsSuppressed(ctx, client, workspaceID, unsuppressedIDs, false)
+	if err != nil {
+		return 0, 0, err
 	}
 
-	// insert the leads into the queue
-	var queueDocuments []interface{}
-	for _, q := range queue {
-		queueDocuments = append(queueDocuments, q)
+	// InsertMany rejects an empty slice
+	if len(queueDocuments) == 0 {
+		return 0, len(suppressedIDs), nil
+	}
+	// the whole list is rejected rather than queueing the part the credits cover
+	err = reserveCredits(ctx, client, workspaceID, len(queueDocuments))
+	if err != nil {
+		return 0, 0, err
+	}
+	err = markListVerificationPending(ctx, client, workspaceID, listID)
+	if err != nil {
+		return 0, 0, errors.Join(err, refundCredits(ctx, client, workspaceID, int64(len(queueDocuments))))
+	}
+	inserted, err := insertIgnoringDuplicates(ctx, queueCollection, queueDocuments)
+	// items that were queued meanwhile or failed to insert don't keep their credits
+	refundErr := refundCredits(ctx, client, workspaceID, int64(len(queueDocuments)-inserted))
+	if err != nil || refundErr != nil {
+		return 0, 0, errors.Join(err, refundErr)
 	}
-	_, err = queueCollection.InsertMany(context.TODO(), queueDocuments)
+	return inserted, len(suppressedIDs), startListProgress(ctx, client, workspaceID, listID)
+}
+
+// markListVerificationPending flags the list so that completeListVerification reports it
+// once its queue items are all verified. Queueing a list that isn't pending yet starts a
+// new round of verification, which the queue status counts from.
+func markListVerificationPending(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, listID primitive.ObjectID) error {
+	collection := client.Database(config.Database).Collection("lists")
+	_, err := collection.UpdateOne(ctx, bson.M{"_id": listID, "workspace_id": workspaceID}, mongo.Pipeline{{{Key: "$set", Value: bson.M{
+		"verification_started_at": bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$verification_pending", true}}, "$verification_started_at", time.Now()}},
+		"verification_pending":    true,
+	}}}})
 	return err
 }
 
-func IsListInQueue(client *mongo.Client, listID primitive.ObjectID) (bool, error) {
-	collection := client.Database("email_verify").Collection("verification_queue")
-	count, err := collection.CountDocuments(context.TODO(), bson.M{"list_id": listID})
+// completeListVerification reports whether the list's last queue item was just verified.
+// Only one caller gets true per round of verification, even when several workers finish
+// the last items at the same time.
+func completeListVerification(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, listID primitive.ObjectID) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	inQueue, err := IsListInQueue(ctx, client, workspaceID, listID)
+	if err != nil || inQueue {
+		return false, err
+	}
+	collection := client.Database(config.Database).Collection("lists")
+	res, err := collection.UpdateOne(ctx, bson.M{"_id": listID, "workspace_id": workspaceID, "verification_pending": true}, bson.M{"$unset": bson.M{"verification_pending": ""}})
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+// queuedLeadIDs returns the ids of the leads of the list that are already in the queue
+func queuedLeadIDs(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, listID primitive.ObjectID) (map[primitive.ObjectID]bool, error) {
+	collection := client.Database(config.Database).Collection("verification_queue")
+	cursor, err := collection.Find(ctx, bson.M{"list_id": listID, "workspace_id": workspaceID}, options.Find().SetProjection(bson.M{"lead_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	queued := make(map[primitive.ObjectID]bool)
+	for cursor.Next(ctx) {
+		var q VerificationQueue
+		cursor.Decode(&q)
+		queued[q.LeadID] = true
+	}
+	return queued, cursor.Err()
+}
+
+// insertIgnoringDuplicates inserts the documents unordered and treats duplicate key
+// errors as skipped documents. It returns the number of documents inserted, which
+// on other write errors are the ones that didn't fail.
+func insertIgnoringDuplicates(ctx context.Context, collection *mongo.Collection, documents []interface{}) (int, error) {
+	_, err := collection.InsertMany(ctx, documents, options.InsertMany().SetOrdered(false))
+	if err == nil {
+		return len(documents), nil
+	}
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil {
+		return 0, err
+	}
+	inserted := len(documents) - len(bulkErr.WriteErrors)
+	for _, writeErr := range bulkErr.WriteErrors {
+		if writeErr.Code != 11000 {
+			return inserted, err
+		}
+	}
+	return inserted, nil
+}
+
+// EnqueueLead adds a single lead to the queue with its list's queue priority. A lead
+// matching the suppression list is marked suppressed instead, which the returned lead tells.
+func EnqueueLead(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, lead Lead) (Lead, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	list, err := GetList(ctx, client, workspaceID, lead.ListID)
+	if err != nil {
+		return Lead{}, err
+	}
+	lead.Suppressed, err = IsSuppressed(ctx, client, workspaceID, lead.Email)
+	if err != nil {
+		return Lead{}, err
+	}
+	err = markLeadsSuppressed(ctx, client, workspaceID, []primitive.ObjectID{lead.ID}, lead.Suppressed)
+	if err != nil || lead.Suppressed {
+		return lead, err
+	}
+	err = reserveCredits(ctx, client, workspaceID, 1)
+	if err != nil {
+		return Lead{}, err
+	}
+	err = markListVerificationPending(ctx, client, workspaceID, lead.ListID)
+	if err != nil {
+		return Lead{}, errors.Join(err, refundCredits(ctx, client, workspaceID, 1))
+	}
+	now := time.Now()
+	collection := client.Database(config.Database).Collection("verification_queue")
+	_, err = collection.InsertOne(ctx, VerificationQueue{WorkspaceID: workspaceID, Email: lead.Email, Domain: emailDomain(lead.Email), LeadID: lead.ID, ListID: lead.ListID, Priority: list.QueuePriority, EnqueuedAt: now, Position: queuePosition(now, list.QueuePriority), Status: QueueStatusPending, Reserved: true})
+	// the lead is already queued and paid for
+	if mongo.IsDuplicateKeyError(err) {
+		return lead, refundCredits(ctx, client, workspaceID, 1)
+	}
+	if err != nil {
+		return Lead{}, errors.Join(err, refundCredits(ctx, client, workspaceID, 1))
+	}
+	return lead, startListProgress(ctx, client, workspaceID, lead.ListID)
+}
+
+func IsListInQueue(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, listID primitive.ObjectID) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("verification_queue")
+	count, err := collection.CountDocuments(ctx, bson.M{"list_id": listID, "workspace_id": workspaceID})
 	if err != nil {
 		return false, err
 	}
@@ -48,51 +284,453 @@ func IsListInQueue(client *mongo.Client, listID primitive.ObjectID) (bool, error
 	}
 }
 
-func RemoveListFromQueue(client *mongo.Client, listID primitive.ObjectID) error {
-	// remove all leads in the list from the queue
-	queueCollection := client.Database("email_verify").Collection("verification_queue")
-	_, err := queueCollection.DeleteMany(context.TODO(), bson.M{"lead_id": bson.M{"$in": listID}})
-	return err
+// RemoveListFromQueue cancels verification of the list by removing all of its pending queue items
+func RemoveListFromQueue(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, listID primitive.ObjectID) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.BulkTimeout)
+	defer cancel()
+
+	removed, err := deleteQueueItems(ctx, client, workspaceID, bson.M{"list_id": listID})
+	if err != nil {
+		return 0, err
+	}
+	listsCollection := client.Database(config.Database).Collection("lists")
+	_, err = listsCollection.UpdateOne(ctx, bson.M{"_id": listID, "workspace_id": workspaceID, "progress": bson.M{"$exists": true}}, bson.M{"$set": bson.M{"progress.queued": 0}})
+	if err != nil {
+		return 0, err
+	}
+	// the round is over, queueing the list again starts a new one
+	_, err = listsCollection.UpdateOne(ctx, bson.M{"_id": listID, "workspace_id": workspaceID}, bson.M{"$unset": bson.M{"verification_pending": ""}})
+	if err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// moveQueueItems moves the queue items of the leads to targetListID, keeping the queued
+// counts of the lists they leave and of the target in step, and returns how many were moved
+func moveQueueItems(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, leadIDs []primitive.ObjectID, targetListID primitive.ObjectID) (int64, error) {
+	filter := bson.M{"lead_id": bson.M{"$in": leadIDs}, "workspace_id": workspaceID, "list_id": bson.M{"$ne": targetListID}}
+	queueCollection := client.Database(config.Database).Collection("verification_queue")
+	cursor, err := queueCollection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$group", Value: bson.M{"_id": "$list_id", "count": bson.M{"$sum": 1}}}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	var sources []struct {
+		ListID primitive.ObjectID `bson:"_id"`
+		Count  int64              `bson:"count"`
+	}
+	err = cursor.All(ctx, &sources)
+	if err != nil || len(sources) == 0 {
+		return 0, err
+	}
+
+	res, err := queueCollection.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"list_id": targetListID}})
+	if err != nil {
+		return 0, err
+	}
+	listsCollection := client.Database(config.Database).Collection("lists")
+	for _, source := range sources {
+		_, err = listsCollection.UpdateOne(ctx,
+			bson.M{"_id": source.ListID, "workspace_id": workspaceID, "progress": bson.M{"$exists": true}},
+			bson.M{"$inc": bson.M{"progress.queued": -source.Count}})
+		if err != nil {
+			return 0, err
+		}
+		// a list left without queue items has no round of verification to report
+		_, err = completeListVerification(ctx, client, workspaceID, source.ListID)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if res.ModifiedCount > 0 {
+		_, err = listsCollection.UpdateOne(ctx,
+			bson.M{"_id": targetListID, "workspace_id": workspaceID, "progress": bson.M{"$exists": true}},
+			bson.M{"$inc": bson.M{"progress.queued": res.ModifiedCount}})
+		if err != nil {
+			return 0, err
+		}
+		// the target reports the round of verification once the moved items are verified
+		err = markListVerificationPending(ctx, client, workspaceID, targetListID)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return res.ModifiedCount, nil
+}
+
+// deleteQueueItems removes the workspace's queue items matching filter, refunding the credits
+// reserved for them, and returns how many were removed
+func deleteQueueItems(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, filter bson.M) (int64, error) {
+	collection := client.Database(config.Database).Collection("verification_queue")
+	filter["workspace_id"] = workspaceID
+	filter["reserved"] = true
+	reserved, err := collection.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	err = refundCredits(ctx, client, workspaceID, reserved.DeletedCount)
+	if err != nil {
+		return 0, err
+	}
+	// items queued before credits were reserved have nothing to refund
+	delete(filter, "reserved")
+	rest, err := collection.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	return reserved.DeletedCount + rest.DeletedCount, nil
+}
+
+// SetListQueuePaused pauses or resumes verification of the list. Queue items of a
+// paused list stay where they are and are skipped by the worker until resumed.
+func SetListQueuePaused(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, listID primitive.ObjectID, paused bool) error {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("lists")
+	res, err := collection.UpdateOne(ctx, bson.M{"_id": listID, "workspace_id": workspaceID}, bson.M{"$set": bson.M{"queue_paused": paused}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// IsListQueuePaused reports whether verification of the list is currently paused
+func IsListQueuePaused(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, listID primitive.ObjectID) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("lists")
+	count, err := collection.CountDocuments(ctx, bson.M{"_id": listID, "workspace_id": workspaceID, "queue_paused": true})
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
 }
 
-func GetQueue(client *mongo.Client) ([]VerificationQueue, error) {
-	collection := client.Database("email_verify").Collection("verification_queue")
-	cursor, err := collection.Find(context.TODO(), bson.M{})
+// GetPausedListIDs returns the ids of all lists whose verification is paused
+func GetPausedListIDs(ctx context.Context, client *mongo.Client) ([]primitive.ObjectID, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("lists")
+	cursor, err := collection.Find(ctx, bson.M{"queue_paused": true})
 	if err != nil {
 		return nil, err
 	}
-	defer cursor.Close(context.TODO())
+	defer cursor.Close(ctx)
+
+	ids := []primitive.ObjectID{}
+	for cursor.Next(ctx) {
+		var list List
+		cursor.Decode(&list)
+		ids = append(ids, list.ID)
+	}
+	return ids, cursor.Err()
+}
+
+// GetQueue returns up to limit pending queue items that are ready to be verified, skipping
+// paused lists and items for the domains in excludeDomains. Items are ordered by priority,
+// where time spent waiting raises an item's priority by one level every queuePriorityAging,
+// then by queue order; see queuePosition.
+func GetQueue(ctx context.Context, client *mongo.Client, excludeDomains []string, limit int64) ([]VerificationQueue, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	pausedListIDs, err := GetPausedListIDs(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	if excludeDomains == nil {
+		excludeDomains = []string{}
+	}
+
+	collection := client.Database(config.Database).Collection("verification_queue")
+	// walking the position index stops after limit matches instead of sorting the whole queue
+	cursor, err := collection.Find(ctx,
+		bson.M{"list_id": bson.M{"$nin": pausedListIDs}, "status": bson.M{"$ne": QueueStatusInFlight}, "domain": bson.M{"$nin": excludeDomains}},
+		options.Find().SetSort(queuePositionIndex).SetHint(queuePositionIndex).SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
 
 	var queue []VerificationQueue
-	for cursor.Next(context.Background()) {
+	for cursor.Next(ctx) {
 		var q VerificationQueue
 		cursor.Decode(&q)
 		queue = append(queue, q)
 	}
-	return queue, nil
+	return queue, cursor.Err()
 }
 
-func GetQueueCount(client *mongo.Client) (int64, error) {
-	collection := client.Database("email_verify").Collection("verification_queue")
-	return collection.CountDocuments(context.TODO(), bson.M{})
+func GetQueueCount(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("verification_queue")
+	return collection.CountDocuments(ctx, bson.M{"workspace_id": workspaceID})
 }
 
-func Dequeue(client *mongo.Client, queueItemId primitive.ObjectID, EmailIsValid string, VerificationResult bson.M) error {
-	collection := client.Database("email_verify").Collection("verification_queue")
+// ClaimQueueItem marks the item as being verified. It returns false when the item
+// is gone or another worker claimed it first.
+func ClaimQueueItem(ctx context.Context, client *mongo.Client, queueItemId primitive.ObjectID) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("verification_queue")
+	res, err := collection.UpdateOne(ctx, bson.M{"_id": queueItemId, "status": bson.M{"$ne": QueueStatusInFlight}}, bson.M{"$set": bson.M{"status": QueueStatusInFlight, "claimed_at": time.Now()}})
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount > 0, nil
+}
+
+// ReleaseQueueItem puts a claimed item back so it can be picked up again
+func ReleaseQueueItem(ctx context.Context, client *mongo.Client, queueItemId primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("verification_queue")
+	_, err := collection.UpdateOne(ctx, bson.M{"_id": queueItemId}, bson.M{"$set": bson.M{"status": QueueStatusPending}, "$unset": bson.M{"claimed_at": ""}})
+	return err
+}
+
+// ReleaseStaleClaims puts items that were claimed longer than olderThan ago back in the
+// queue. Such claims belong to a worker that stopped without releasing them.
+func ReleaseStaleClaims(ctx context.Context, client *mongo.Client, olderThan time.Duration) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.BulkTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("verification_queue")
+	res, err := collection.UpdateMany(ctx, bson.M{"status": QueueStatusInFlight, "claimed_at": bson.M{"$lt": time.Now().Add(-olderThan)}}, bson.M{"$set": bson.M{"status": QueueStatusPending}, "$unset": bson.M{"claimed_at": ""}})
+	if err != nil {
+		return 0, err
+	}
+	return res.ModifiedCount, nil
+}
+
+// Dequeue removes the queue item, stores the verification result on the lead and returns
+// the list's updated progress. verificationError is set when the verification could not be completed.
+// It returns mongo.ErrNoDocuments, storing nothing, when the item was removed meanwhile.
+func Dequeue(ctx context.Context, client *mongo.Client, queueItemId primitive.ObjectID, EmailIsValid string, VerificationResult bson.M, verificationError string) (ListProgress, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	// removing the item first settles a race with a removal that refunds its credit
+	collection := client.Database(config.Database).Collection("verification_queue")
 	queueItem := VerificationQueue{}
-	err := collection.FindOne(context.TODO(), bson.M{"_id": queueItemId}).Decode(&queueItem)
+	err := collection.FindOneAndDelete(ctx, bson.M{"_id": queueItemId}).Decode(&queueItem)
 	if err != nil {
-		return err
+		return ListProgress{}, err
 	}
 
 	// update the lead
-	leadsCollection := client.Database("email_verify").Collection("leads")
-	_, err = leadsCollection.UpdateOne(context.TODO(), bson.M{"_id": queueItem.LeadID}, bson.M{"$set": bson.M{"email_is_valid": EmailIsValid, "verification_result": VerificationResult, "email_verified": true}})
+	leadsCollection := client.Database(config.Database).Collection("leads")
+	update := verificationUpdate(EmailIsValid, VerificationResult, verificationError)
+	// the previous result is needed to move the lead between the progress counters
+	var previous Lead
+	err = leadsCollection.FindOneAndUpdate(ctx, bson.M{"_id": queueItem.LeadID, "workspace_id": queueItem.WorkspaceID}, update,
+		options.FindOneAndUpdate().SetProjection(bson.M{"email_verified": 1, "email_is_valid": 1}),
+	).Decode(&previous)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return ListProgress{}, err
+	}
+
+	// the probe was made, so it costs a credit even when it failed
+	if queueItem.Reserved {
+		err = countVerification(ctx, client, queueItem.WorkspaceID)
+	} else {
+		err = chargeVerification(ctx, client, queueItem.WorkspaceID)
+	}
 	if err != nil {
-		return err
+		return ListProgress{}, err
 	}
 
-	// remove the queue item
-	_, err = collection.DeleteOne(context.TODO(), bson.M{"_id": queueItemId})
-	return err
+	inc := bson.M{"progress.queued": -1}
+	if previous.EmailVerified {
+		if field := progressField(previous.EmailIsValid); field != "" {
+			inc[field] = -1
+		}
+	} else {
+		inc["progress.verified"] = 1
+	}
+	if field := progressField(EmailIsValid); field != "" {
+		n, _ := inc[field].(int)
+		inc[field] = n + 1
+	}
+	listsCollection := client.Database(config.Database).Collection("lists")
+	var list List
+	err = listsCollection.FindOneAndUpdate(ctx,
+		bson.M{"_id": queueItem.ListID, "workspace_id": queueItem.WorkspaceID, "progress": bson.M{"$exists": true}},
+		bson.M{"$inc": inc},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&list)
+	// lists queued before progress was tracked have none
+	if err == mongo.ErrNoDocuments {
+		return ListProgress{}, nil
+	}
+	if err != nil {
+		return ListProgress{}, err
+	}
+	return *list.Progress, nil
+}
+
+// DropSuppressedQueueItem removes a queue item whose lead was suppressed after it was
+// queued, marks the lead suppressed and returns the list's updated progress. Nothing is charged.
+func DropSuppressedQueueItem(ctx context.Context, client *mongo.Client, q VerificationQueue) (ListProgress, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	err := markLeadsSuppressed(ctx, client, q.WorkspaceID, []primitive.ObjectID{q.LeadID}, true)
+	if err != nil {
+		return ListProgress{}, err
+	}
+	return DropQueueItem(ctx, client, q)
+}
+
+// DropQueueItem removes a queue item without verifying it, refunding its credit, and
+// returns the list's updated progress
+func DropQueueItem(ctx context.Context, client *mongo.Client, q VerificationQueue) (ListProgress, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	_, err := deleteQueueItems(ctx, client, q.WorkspaceID, bson.M{"_id": q.ID})
+	if err != nil {
+		return ListProgress{}, err
+	}
+
+	listsCollection := client.Database(config.Database).Collection("lists")
+	var list List
+	err = listsCollection.FindOneAndUpdate(ctx,
+		bson.M{"_id": q.ListID, "workspace_id": q.WorkspaceID, "progress": bson.M{"$exists": true}},
+		bson.M{"$inc": bson.M{"progress.queued": -1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&list)
+	// lists queued before progress was tracked have none
+	if err == mongo.ErrNoDocuments {
+		return ListProgress{}, nil
+	}
+	if err != nil {
+		return ListProgress{}, err
+	}
+	return *list.Progress, nil
+}
+
+// the default window throughput is measured over
+const queueThroughputWindow = 15 * time.Minute
+
+// QueueStatus describes the progress of the queue, either overall or for one list
+type QueueStatus struct {
+	Pending             int64      `json:"pending"`
+	InFlight            int64      `json:"in_flight"`
+	Completed           int64      `json:"completed"`
+	Failed              int64      `json:"failed"`
+	ThroughputPerMinute float64    `json:"throughput_per_minute"`
+	Window              string     `json:"window"`
+	ETASeconds          *float64   `json:"eta_seconds"`
+	EstimatedCompletion *time.Time `json:"estimated_completion"`
+}
+
+// GetQueueStatus counts the queue items and verified leads of the list, or of all lists
+// when listID is nil. Completed and failed count the leads verified since the latest round
+// of verification of their list started. Throughput is the number of leads verified over
+// the last window, the ETA assumes the remaining items are verified at that rate.
+func GetQueueStatus(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, listID *primitive.ObjectID, window time.Duration) (QueueStatus, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	status := QueueStatus{Window: window.String()}
+	rounds, err := verificationRounds(ctx, client, workspaceID, listID)
+	if err != nil {
+		return status, err
+	}
+	scope := func(filter bson.M) bson.M {
+		filter["workspace_id"] = workspaceID
+		if listID != nil {
+			filter["list_id"] = *listID
+		}
+		return filter
+	}
+
+	queueCollection := client.Database(config.Database).Collection("verification_queue")
+	total, err := queueCollection.CountDocuments(ctx, scope(bson.M{}))
+	if err != nil {
+		return status, err
+	}
+	status.InFlight, err = queueCollection.CountDocuments(ctx, scope(bson.M{"status": QueueStatusInFlight}))
+	if err != nil {
+		return status, err
+	}
+	status.Pending = total - status.InFlight
+
+	leadsCollection := client.Database(config.Database).Collection("leads")
+	// "$or" rejects an empty list
+	if len(rounds) > 0 {
+		status.Completed, err = leadsCollection.CountDocuments(ctx, scope(bson.M{"$or": rounds, "verification_error": bson.M{"$exists": false}}))
+		if err != nil {
+			return status, err
+		}
+		status.Failed, err = leadsCollection.CountDocuments(ctx, scope(bson.M{"$or": rounds, "verification_error": bson.M{"$exists": true}}))
+		if err != nil {
+			return status, err
+		}
+	}
+
+	now := time.Now()
+	recent, err := leadsCollection.CountDocuments(ctx, scope(bson.M{"verified_at": bson.M{"$gte": now.Add(-window)}}))
+	if err != nil {
+		return status, err
+	}
+	status.ThroughputPerMinute = float64(recent) / window.Minutes()
+
+	if total > 0 && status.ThroughputPerMinute > 0 {
+		eta := float64(total) / status.ThroughputPerMinute * 60
+		completion := now.Add(time.Duration(eta * float64(time.Second)))
+		status.ETASeconds = &eta
+		status.EstimatedCompletion = &completion
+	}
+	return status, nil
+}
+
+// verificationRounds returns a lead filter per list, the list or all lists of the workspace
+// when listID is nil, matching the leads verified in the list's latest round of verification.
+// An unknown list is mongo.ErrNoDocuments.
+func verificationRounds(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, listID *primitive.ObjectID) (bson.A, error) {
+	var lists []List
+	if listID != nil {
+		list, err := GetList(ctx, client, workspaceID, *listID)
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, list)
+	} else {
+		collection := client.Database(config.Database).Collection("lists")
+		cursor, err := collection.Find(ctx,
+			bson.M{"workspace_id": workspaceID, "verification_started_at": bson.M{"$exists": true}, "deleted_at": bson.M{"$exists": false}},
+			options.Find().SetProjection(bson.M{"verification_started_at": 1}))
+		if err != nil {
+			return nil, err
+		}
+		err = cursor.All(ctx, &lists)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rounds := bson.A{}
+	for _, list := range lists {
+		// lists queued before rounds were tracked have none
+		if list.VerificationStartedAt == nil {
+			continue
+		}
+		rounds = append(rounds, bson.M{"list_id": list.ID, "email_verified": true, "verified_at": bson.M{"$gte": *list.VerificationStartedAt}})
+	}
+	return rounds, nil
 }
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// kinds of rate limits
+const (
+	RateLimitDomain = "domain"
+	RateLimitMX     = "mx"
+)
+
+// limits applied to recipient domains and MX hosts that have no rate limit of their own.
+// Zero means unlimited.
+var (
+	defaultDomainRateLimit = RateLimit{MaxConcurrent: 2, PerMinute: 60}
+	defaultMXRateLimit     = RateLimit{MaxConcurrent: 5, PerMinute: 120}
+)
+
+// RateLimit caps SMTP probing of one recipient domain or MX host. An MX rate limit
+// also covers every MX host under it, e.g. "google.com" covers "aspmx.l.google.com".
+type RateLimit struct {
+	Kind          string `bson:"kind" json:"kind"`
+	Host          string `bson:"host" json:"host"`
+	MaxConcurrent int    `bson:"max_concurrent" json:"max_concurrent"`
+	PerMinute     int    `bson:"per_minute" json:"per_minute"`
+}
+
+func GetRateLimits(ctx context.Context, client *mongo.Client) ([]RateLimit, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("rate_limits")
+	cursor, err := collection.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var limits []RateLimit
+	for cursor.Next(ctx) {
+		var limit RateLimit
+		cursor.Decode(&limit)
+		limits = append(limits, limit)
+	}
+	return limits, cursor.Err()
+}
+
+// SetRateLimit creates or replaces the rate limit for limit.Kind and limit.Host
+func SetRateLimit(ctx context.Context, client *mongo.Client, limit RateLimit) error {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("rate_limits")
+	_, err := collection.ReplaceOne(ctx, bson.M{"kind": limit.Kind, "host": limit.Host}, limit, options.Replace().SetUpsert(true))
+	return err
+}
+
+func DeleteRateLimit(ctx context.Context, client *mongo.Client, kind string, host string) error {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("rate_limits")
+	res, err := collection.DeleteOne(ctx, bson.M{"kind": kind, "host": host})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// emailDomain returns the lower cased domain part of the email
+func emailDomain(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(email[at+1:])
+}
+
+// how long resolving the MX host of a domain may take before its probes only count
+// against the domain's own limit
+const mxLookupTimeout = 5 * time.Second
+
+// how long the MX host of a domain is remembered, and a failed lookup of it
+const (
+	mxCacheTTL        = time.Hour
+	mxFailureCacheTTL = time.Minute
+)
+
+// how many MX lookups resolveDomains runs at once
+const mxLookupConcurrency = 16
+
+// how often idle hosts and expired MX hosts are forgotten
+const limiterSweepInterval = time.Minute
+
+// probeLimiter is shared by all worker runs and synchronous verifications of this process,
+// so the limits hold however many of them run at once
+var probeLimiter = newHostLimiter(nil)
+
+// hostLimiter keeps track of the probes running against each domain and MX host
+// and decides whether another one may start
+type hostLimiter struct {
+	mu         sync.Mutex
+	limits     map[string]RateLimit
+	mxLimits   []RateLimit
+	mxByDomain map[string]resolvedMX
+	inFlight   map[string]int
+	started    map[string][]time.Time
+	released   chan struct{}
+	resolver   *net.Resolver
+	lastSweep  time.Time
+}
+
+// resolvedMX is the MX rate limit bucket of a domain, "" when it has no MX host or the
+// lookup failed
+type resolvedMX struct {
+	host       string
+	resolvedAt time.Time
+	failed     bool
+}
+
+// expired reports whether the domain's MX host has to be looked up again
+func (mx resolvedMX) expired(now time.Time) bool {
+	ttl := mxCacheTTL
+	if mx.failed {
+		ttl = mxFailureCacheTTL
+	}
+	return now.Sub(mx.resolvedAt) > ttl
+}
+
+func newHostLimiter(limits []RateLimit) *hostLimiter {
+	l := &hostLimiter{
+		mxByDomain: make(map[string]resolvedMX),
+		inFlight:   make(map[string]int),
+		started:    make(map[string][]time.Time),
+		released:   make(chan struct{}, 1),
+		resolver:   net.DefaultResolver,
+	}
+	l.setLimits(limits)
+	return l
+}
+
+// setLimits replaces the configured rate limits. Probes that are running keep counting.
+func (l *hostLimiter) setLimits(limits []RateLimit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limits = make(map[string]RateLimit)
+	l.mxLimits = nil
+	for _, limit := range limits {
+		l.limits[limit.Kind+":"+limit.Host] = limit
+		if limit.Kind == RateLimitMX {
+			l.mxLimits = append(l.mxLimits, limit)
+		}
+	}
+	// the MX buckets depend on the MX limits
+	l.mxByDomain = make(map[string]resolvedMX)
+}
+
+// keys returns the rate limit buckets a probe of domain counts against, looking up the
+// domain's MX host unless it is known. A domain whose lookup failed lately only counts
+// against its own bucket until the lookup is tried again.
+func (l *hostLimiter) keys(ctx context.Context, domain string) []string {
+	l.mu.Lock()
+	mx, resolved := l.mxByDomain[domain]
+	l.mu.Unlock()
+	if !resolved || mx.expired(time.Now()) {
+		mx = l.lookupMX(ctx, domain)
+	}
+
+	keys := []string{RateLimitDomain + ":" + domain}
+	if mx.host != "" {
+		keys = append(keys, RateLimitMX+":"+mx.host)
+	}
+	return keys
+}
+
+// resolveDomains looks up the MX hosts of the domains that aren't known, several at once,
+// so the worker doesn't wait on one lookup after another while it dispatches a batch
+func (l *hostLimiter) resolveDomains(ctx context.Context, domains []string) {
+	now := time.Now()
+	pending := make(map[string]bool)
+	l.mu.Lock()
+	for _, domain := range domains {
+		if mx, resolved := l.mxByDomain[domain]; !resolved || mx.expired(now) {
+			pending[domain] = true
+		}
+	}
+	l.mu.Unlock()
+
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, mxLookupConcurrency)
+	for domain := range pending {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(domain string) {
+			defer wg.Done()
+			l.lookupMX(ctx, domain)
+			<-semaphore
+		}(domain)
+	}
+	wg.Wait()
+}
+
+// lookupMX resolves the MX host of domain and remembers it, or remembers that the lookup failed
+func (l *hostLimiter) lookupMX(ctx context.Context, domain string) resolvedMX {
+	host, err := l.resolveMX(ctx, domain)
+	mx := resolvedMX{host: host, resolvedAt: time.Now(), failed: err != nil}
+	// a lookup cut short by the caller says nothing about the domain
+	if ctx.Err() == nil {
+		l.mu.Lock()
+		l.mxByDomain[domain] = mx
+		l.mu.Unlock()
+	}
+	return mx
+}
+
+// resolveMX looks up the preferred MX host of domain and maps it onto the
+// configured MX rate limit covering it, if any. A domain without MX records has no host.
+func (l *hostLimiter) resolveMX(ctx context.Context, domain string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, mxLookupTimeout)
+	defer cancel()
+
+	records, err := l.resolver.LookupMX(ctx, domain)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(records) == 0 {
+		return "", nil
+	}
+	host := strings.ToLower(strings.TrimSuffix(records[0].Host, "."))
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, limit := range l.mxLimits {
+		if host == limit.Host || strings.HasSuffix(host, "."+limit.Host) {
+			return limit.Host, nil
+		}
+	}
+	return host, nil
+}
+
+func (l *hostLimiter) limitFor(key string) RateLimit {
+	if limit, ok := l.limits[key]; ok {
+		return limit
+	}
+	if strings.HasPrefix(key, RateLimitMX+":") {
+		return defaultMXRateLimit
+	}
+	return defaultDomainRateLimit
+}
+
+// saturated reports whether no further probe may start against key. Callers hold l.mu.
+func (l *hostLimiter) saturated(key string, now time.Time) bool {
+	limit := l.limitFor(key)
+	if limit.MaxConcurrent > 0 && l.inFlight[key] >= limit.MaxConcurrent {
+		return true
+	}
+	if limit.PerMinute > 0 {
+		recent := l.started[key][:0]
+		for _, t := range l.started[key] {
+			if now.Sub(t) < time.Minute {
+				recent = append(recent, t)
+			}
+		}
+		l.started[key] = recent
+		if len(recent) >= limit.PerMinute {
+			return true
+		}
+	}
+	return false
+}
+
+// tryAcquire starts a probe against all keys if none of them is saturated
+func (l *hostLimiter) tryAcquire(keys []string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for _, key := range keys {
+		if l.saturated(key, now) {
+			return false
+		}
+	}
+	for _, key := range keys {
+		l.inFlight[key]++
+		l.started[key] = append(l.started[key], now)
+	}
+	return true
+}
+
+func (l *hostLimiter) release(keys []string) {
+	l.mu.Lock()
+	for _, key := range keys {
+		l.inFlight[key]--
+	}
+	// synchronous verifications release without the worker ever sweeping
+	if now := time.Now(); now.Sub(l.lastSweep) > limiterSweepInterval {
+		l.sweep(now)
+	}
+	l.mu.Unlock()
+	select {
+	case l.released <- struct{}{}:
+	default:
+	}
+}
+
+// acquire waits until a probe against keys may start and starts it, or returns ctx's
+// error when ctx ends first
+func (l *hostLimiter) acquire(ctx context.Context, keys []string) error {
+	for !l.tryAcquire(keys) {
+		l.wait(ctx, rateLimitPollInterval)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blockedDomains returns the domains that currently can't be probed, either
+// because of their own limit or because their MX host is saturated
+func (l *hostLimiter) blockedDomains() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	seen := make(map[string]bool)
+	blocked := []string{}
+	// domains probed lately, including those whose MX host couldn't be resolved
+	for key := range l.started {
+		domain, isDomain := strings.CutPrefix(key, RateLimitDomain+":")
+		if isDomain && l.saturated(key, now) {
+			seen[domain] = true
+			blocked = append(blocked, domain)
+		}
+	}
+	l.sweep(now)
+	for domain, mx := range l.mxByDomain {
+		if !seen[domain] && mx.host != "" && l.saturated(RateLimitMX+":"+mx.host, now) {
+			blocked = append(blocked, domain)
+		}
+	}
+	return blocked
+}
+
+// sweep forgets hosts without probes in flight or in the last minute, and MX hosts that
+// have to be looked up again. Callers hold l.mu.
+func (l *hostLimiter) sweep(now time.Time) {
+	l.lastSweep = now
+	for key, started := range l.started {
+		recent := started[:0]
+		for _, t := range started {
+			if now.Sub(t) < time.Minute {
+				recent = append(recent, t)
+			}
+		}
+		l.started[key] = recent
+		if len(recent) == 0 && l.inFlight[key] <= 0 {
+			delete(l.started, key)
+		}
+	}
+	for key, n := range l.inFlight {
+		if n <= 0 && len(l.started[key]) == 0 {
+			delete(l.inFlight, key)
+		}
+	}
+	for domain, mx := range l.mxByDomain {
+		if mx.expired(now) {
+			delete(l.mxByDomain, domain)
+		}
+	}
+}
+
+// wait blocks until a probe finishes, timeout passes or ctx is cancelled, whichever comes first
+func (l *hostLimiter) wait(ctx context.Context, timeout time.Duration) {
+	select {
+	case <-l.released:
+	case <-time.After(timeout):
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHostLimiterMaxConcurrent(t *testing.T) {
+	l := newHostLimiter([]RateLimit{{Kind: RateLimitDomain, Host: "example.com", MaxConcurrent: 2}})
+	keys := []string{"domain:example.com"}
+	tests := []struct {
+		name    string
+		release bool
+		want    bool
+	}{
+		{"first probe", false, true},
+		{"second probe", false, true},
+		{"third probe is over the limit", false, false},
+		{"a released probe frees a slot", true, true},
+		{"full again", false, false},
+	}
+	for _, tt := range tests {
+		if tt.release {
+			l.release(keys)
+		}
+		if got := l.tryAcquire(keys); got != tt.want {
+			t.Errorf("%s: tryAcquire() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHostLimiterPerMinute(t *testing.T) {
+	l := newHostLimiter([]RateLimit{{Kind: RateLimitDomain, Host: "example.com", PerMinute: 2}})
+	keys := []string{"domain:example.com"}
+	for i := 0; i < 2; i++ {
+		if !l.tryAcquire(keys) {
+			t.Fatalf("probe %d was refused", i+1)
+		}
+		l.release(keys)
+	}
+	if l.tryAcquire(keys) {
+		t.Error("a third probe within a minute was allowed")
+	}
+	// probes older than a minute no longer count
+	l.mu.Lock()
+	for i := range l.started["domain:example.com"] {
+		l.started["domain:example.com"][i] = time.Now().Add(-2 * time.Minute)
+	}
+	l.mu.Unlock()
+	if !l.tryAcquire(keys) {
+		t.Error("a probe was refused once the earlier ones aged out")
+	}
+}
+
+func TestHostLimiterAllKeysMustBeFree(t *testing.T) {
+	l := newHostLimiter([]RateLimit{{Kind: RateLimitMX, Host: "google.com", MaxConcurrent: 1}})
+	if !l.tryAcquire([]string{"domain:a.com", "mx:google.com"}) {
+		t.Fatal("first probe was refused")
+	}
+	// the MX host is saturated, so another domain on it has to wait, and nothing is counted for it
+	if l.tryAcquire([]string{"domain:b.com", "mx:google.com"}) {
+		t.Fatal("a probe over the MX limit was allowed")
+	}
+	if n := l.inFlight["domain:b.com"]; n != 0 {
+		t.Errorf("a refused probe left %d in flight", n)
+	}
+}
+
+func TestHostLimiterDefaults(t *testing.T) {
+	l := newHostLimiter([]RateLimit{{Kind: RateLimitDomain, Host: "example.com", MaxConcurrent: 9}})
+	tests := []struct {
+		key  string
+		want RateLimit
+	}{
+		{"domain:example.com", RateLimit{Kind: RateLimitDomain, Host: "example.com", MaxConcurrent: 9}},
+		{"domain:other.com", defaultDomainRateLimit},
+		{"mx:aspmx.l.google.com", defaultMXRateLimit},
+	}
+	for _, tt := range tests {
+		if got := l.limitFor(tt.key); got != tt.want {
+			t.Errorf("limitFor(%q) = %+v, want %+v", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestHostLimiterBlockedDomains(t *testing.T) {
+	l := newHostLimiter([]RateLimit{{Kind: RateLimitMX, Host: "google.com", MaxConcurrent: 1}})
+	l.mxByDomain["b.com"] = resolvedMX{host: "google.com", resolvedAt: time.Now()}
+	l.tryAcquire([]string{"domain:a.com", "mx:google.com"})
+	for i := 0; i < defaultDomainRateLimit.MaxConcurrent; i++ {
+		l.tryAcquire([]string{"domain:c.com"})
+	}
+
+	blocked := l.blockedDomains()
+	slices.Sort(blocked)
+	// a.com is under its own limit, b.com shares the saturated MX host, c.com is saturated itself
+	if want := []string{"b.com", "c.com"}; !slices.Equal(blocked, want) {
+		t.Errorf("blockedDomains() = %v, want %v", blocked, want)
+	}
+}
+
+func TestHostLimiterAcquireGivesUpWithContext(t *testing.T) {
+	l := newHostLimiter([]RateLimit{{Kind: RateLimitDomain, Host: "example.com", MaxConcurrent: 1}})
+	keys := []string{"domain:example.com"}
+	l.tryAcquire(keys)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := l.acquire(ctx, keys); err == nil {
+		t.Error("acquire() on a saturated key returned nil after the context ended")
+	}
+}
+
+func TestHostLimiterCachesFailedLookups(t *testing.T) {
+	l := newHostLimiter(nil)
+	var lookups atomic.Int64
+	l.resolver = &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+		lookups.Add(1)
+		return nil, errors.New("no network")
+	}}
+
+	l.resolveDomains(context.Background(), []string{"a.com", "b.com", "a.com"})
+	tried := lookups.Load()
+	if tried == 0 {
+		t.Fatal("resolveDomains() didn't look anything up")
+	}
+	// the failures are remembered, so neither a later batch nor keys() looks them up again
+	l.resolveDomains(context.Background(), []string{"a.com", "b.com"})
+	if keys := l.keys(context.Background(), "a.com"); !slices.Equal(keys, []string{"domain:a.com"}) {
+		t.Errorf("keys() of a domain whose lookup failed = %v", keys)
+	}
+	if n := lookups.Load(); n != tried {
+		t.Errorf("failed lookups were retried right away: %d dials, want %d", n, tried)
+	}
+
+	// a failed lookup is tried again once it expires
+	l.mu.Lock()
+	l.mxByDomain["a.com"] = resolvedMX{resolvedAt: time.Now().Add(-2 * mxFailureCacheTTL), failed: true}
+	l.mu.Unlock()
+	l.keys(context.Background(), "a.com")
+	if lookups.Load() == tried {
+		t.Error("an expired failed lookup wasn't tried again")
+	}
+}
+
+func TestHostLimiterSweep(t *testing.T) {
+	l := newHostLimiter(nil)
+	now := time.Now()
+	l.tryAcquire([]string{"domain:busy.com"})
+	l.tryAcquire([]string{"domain:recent.com"})
+	l.release([]string{"domain:recent.com"})
+	l.tryAcquire([]string{"domain:idle.com"})
+	l.release([]string{"domain:idle.com"})
+	l.mu.Lock()
+	l.started["domain:idle.com"] = []time.Time{now.Add(-2 * time.Minute)}
+	l.mxByDomain["fresh.com"] = resolvedMX{host: "mx.fresh.com", resolvedAt: now}
+	l.mxByDomain["stale.com"] = resolvedMX{host: "mx.stale.com", resolvedAt: now.Add(-2 * mxCacheTTL)}
+	l.sweep(now)
+	l.mu.Unlock()
+
+	for _, key := range []string{"domain:busy.com", "domain:recent.com"} {
+		if _, ok := l.started[key]; !ok {
+			t.Errorf("sweep() forgot %s, which was probed within the minute", key)
+		}
+	}
+	if _, ok := l.started["domain:idle.com"]; ok {
+		t.Error("sweep() kept an idle host")
+	}
+	if _, ok := l.inFlight["domain:idle.com"]; ok {
+		t.Error("sweep() kept the in-flight count of an idle host")
+	}
+	if _, ok := l.mxByDomain["stale.com"]; ok {
+		t.Error("sweep() kept an expired MX host")
+	}
+	if _, ok := l.mxByDomain["fresh.com"]; !ok {
+		t.Error("sweep() forgot a fresh MX host")
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	emailVerifier "github.com/AfterShip/email-verifier"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// kinds of suppression entries, told apart by their value
+const (
+	SuppressionEmail    = "email"    // jane@example.com
+	SuppressionDomain   = "domain"   // example.com
+	SuppressionWildcard = "wildcard" // *@example.com, *.example.com, trap-*@example.com
+)
+
+// Suppression is an email address or domain whose leads are never verified or exported
+type Suppression struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	WorkspaceID primitive.ObjectID `bson:"workspace_id" json:"workspace_id"`
+	Kind        string             `bson:"kind" json:"kind"`
+	Value       string             `bson:"value" json:"value"`
+	Reason      string             `bson:"reason,omitempty" json:"reason,omitempty"`
+	CreatedAt   time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// parseSuppression normalizes value and works out its kind. Wildcards with an @ match
+// whole addresses, the others match domains.
+func parseSuppression(value string) (string, string, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	switch {
+	case value == "":
+		return "", "", badRequest("value is required")
+	case len(value) > maxEmailLength:
+		return "", "", badRequest("value must not be longer than 254 characters")
+	case strings.Contains(value, "*"):
+		if strings.Trim(value, "*.@") == "" {
+			return "", "", badRequest("wildcard " + value + " would suppress everything")
+		}
+		return SuppressionWildcard, value, nil
+	case strings.Contains(value, "@"):
+		if !emailVerifier.IsAddressValid(value) {
+			return "", "", badRequest(value + " is not a valid email address")
+		}
+		return SuppressionEmail, value, nil
+	case strings.Contains(value, ".") && !strings.ContainsAny(value, " /"):
+		return SuppressionDomain, value, nil
+	}
+	return "", "", badRequest(value + " is not an email address, domain or wildcard")
+}
+
+// wildcardPattern turns a wildcard value into a regular expression where * matches anything
+func wildcardPattern(value string) *regexp.Regexp {
+	parts := strings.Split(value, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return regexp.MustCompile("^" + strings.Join(parts, ".*") + "$")
+}
+
+// CreateSuppression adds an entry to the workspace's suppression list
+func CreateSuppression(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, value string, reason string) (Suppression, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	kind, value, err := parseSuppression(value)
+	if err != nil {
+		return Suppression{}, err
+	}
+	suppression := Suppression{ID: primitive.NewObjectID(), WorkspaceID: workspaceID, Kind: kind, Value: value, Reason: reason, CreatedAt: time.Now()}
+	collection := client.Database(config.Database).Collection("suppressions")
+	_, err = collection.InsertOne(ctx, suppression)
+	if mongo.IsDuplicateKeyError(err) {
+		return Suppression{}, conflict(value + " is already suppressed")
+	}
+	if err != nil {
+		return Suppression{}, err
+	}
+	return suppression, nil
+}
+
+func GetSuppressions(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID) ([]Suppression, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("suppressions")
+	cursor, err := collection.Find(ctx, bson.M{"workspace_id": workspaceID}, options.Find().SetSort(bson.M{"value": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	suppressions := []Suppression{}
+	for cursor.Next(ctx) {
+		var suppression Suppression
+		cursor.Decode(&suppression)
+		suppressions = append(suppressions, suppression)
+	}
+	return suppressions, cursor.Err()
+}
+
+func DeleteSuppression(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, id primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("suppressions")
+	res, err := collection.DeleteOne(ctx, bson.M{"_id": id, "workspace_id": workspaceID})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// AddSuppressionsFromCSV adds an entry per row of the uploaded csv file, taken from its
+// value, email or domain column along with an optional reason column. Values that are
+// already suppressed are skipped; it returns how many entries were added.
+func AddSuppressionsFromCSV(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, request *http.Request) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.ImportTimeout)
+	defer cancel()
+
+	file, _, err := request.FormFile("csvfile")
+	if err != nil {
+		return 0, badRequest("csvfile is required: " + err.Error())
+	}
+	defer file.Close()
+
+	csvReader := csv.NewReader(file)
+	header, err := csvReader.Read()
+	if err != nil {
+		return 0, badRequest("reading the csv header: " + err.Error())
+	}
+	valueIdx, reasonIdx := -1, -1
+	for i, h := range header {
+		switch strings.ToLower(strings.TrimSpace(h)) {
+		case "value", "email", "domain":
+			if valueIdx < 0 {
+				valueIdx = i
+			}
+		case "reason":
+			reasonIdx = i
+		}
+	}
+	if valueIdx < 0 {
+		return 0, badRequest("the csv needs a value, email or domain column")
+	}
+
+	var models []mongo.WriteModel
+	for line := 2; ; line++ {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, badRequest(err.Error())
+		}
+		kind, value, err := parseSuppression(record[valueIdx])
+		if err != nil {
+			return 0, badRequest("line " + strconv.Itoa(line) + ": " + err.Error())
+		}
+		reason := ""
+		if reasonIdx >= 0 {
+			reason = record[reasonIdx]
+		}
+		suppression := Suppression{WorkspaceID: workspaceID, Kind: kind, Value: value, Reason: reason, CreatedAt: time.Now()}
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"workspace_id": workspaceID, "value": value}).
+			SetUpdate(bson.M{"$setOnInsert": suppression}).
+			SetUpsert(true))
+	}
+	if len(models) == 0 {
+		return 0, nil
+	}
+
+	collection := client.Database(config.Database).Collection("suppressions")
+	res, err := collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return 0, err
+	}
+	return int(res.UpsertedCount), nil
+}
+
+// suppressionMatcher tells whether an email address is suppressed in a workspace
+type suppressionMatcher struct {
+	emails    map[string]bool
+	domains   map[string]bool
+	wildcards []*regexp.Regexp
+	// wildcards without an @ match the domain only
+	domainWildcards []*regexp.Regexp
+}
+
+func newSuppressionMatcher(suppressions []Suppression) *suppressionMatcher {
+	m := &suppressionMatcher{emails: make(map[string]bool), domains: make(map[string]bool)}
+	for _, suppression := range suppressions {
+		switch suppression.Kind {
+		case SuppressionEmail:
+			m.emails[suppression.Value] = true
+		case SuppressionDomain:
+			m.domains[suppression.Value] = true
+		case SuppressionWildcard:
+			if strings.Contains(suppression.Value, "@") {
+				m.wildcards = append(m.wildcards, wildcardPattern(suppression.Value))
+			} else {
+				m.domainWildcards = append(m.domainWildcards, wildcardPattern(suppression.Value))
+			}
+		}
+	}
+	return m
+}
+
+func (m *suppressionMatcher) matches(email string) bool {
+	email = strings.ToLower(strings.TrimSpace(email))
+	domain := emailDomain(email)
+	if m.emails[email] || m.domains[domain] {
+		return true
+	}
+	for _, pattern := range m.wildcards {
+		if pattern.MatchString(email) {
+			return true
+		}
+	}
+	for _, pattern := range m.domainWildcards {
+		if pattern.MatchString(domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadSuppressions returns the matcher for the workspace's whole suppression list, for
+// checking many leads at once
+func loadSuppressions(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID) (*suppressionMatcher, error) {
+	collection := client.Database(config.Database).Collection("suppressions")
+	cursor, err := collection.Find(ctx, bson.M{"workspace_id": workspaceID})
+	if err != nil {
+		return nil, err
+	}
+	var suppressions []Suppression
+	err = cursor.All(ctx, &suppressions)
+	if err != nil {
+		return nil, err
+	}
+	return newSuppressionMatcher(suppressions), nil
+}
+
+// IsSuppressed reports whether a single email address is suppressed in the workspace.
+// Only the entries that can match it and the wildcards are loaded.
+func IsSuppressed(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, email string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	email = strings.ToLower(strings.TrimSpace(email))
+	collection := client.Database(config.Database).Collection("suppressions")
+	cursor, err := collection.Find(ctx, bson.M{"workspace_id": workspaceID, "$or": bson.A{
+		bson.M{"value": bson.M{"$in": bson.A{email, emailDomain(email)}}},
+		bson.M{"kind": SuppressionWildcard},
+	}})
+	if err != nil {
+		return false, err
+	}
+	var suppressions []Suppression
+	err = cursor.All(ctx, &suppressions)
+	if err != nil {
+		return false, err
+	}
+	return newSuppressionMatcher(suppressions).matches(email), nil
+}
+
+// markLeadsSuppressed flags the leads as suppressed, or clears the flag when suppressed is false
+func markLeadsSuppressed(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, leadIDs []primitive.ObjectID, suppressed bool) error {
+	if len(leadIDs) == 0 {
+		return nil
+	}
+	update := bson.M{"$set": bson.M{"suppressed": true}}
+	if !suppressed {
+		update = bson.M{"$unset": bson.M{"suppressed": ""}}
+	}
+	collection := client.Database(config.Database).Collection("leads")
+	_, err := collection.UpdateMany(ctx, bson.M{"_id": bson.M{"$in": leadIDs}, "workspace_id": workspaceID}, update)
+	return err
+}
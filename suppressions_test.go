@@ -0,0 +1,65 @@
+package main
+
+import "testing"
+
+func TestWildcardPattern(t *testing.T) {
+	tests := []struct {
+		value string
+		input string
+		want  bool
+	}{
+		{"*.example.com", "mail.example.com", true},
+		{"*.example.com", "a.b.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "mailexample.com", false},
+		{"trap-*@example.com", "trap-1@example.com", true},
+		{"trap-*@example.com", "trap-@example.com", true},
+		{"trap-*@example.com", "jane@example.com", false},
+		{"trap-*@example.com", "trap-1@example.com.evil", false},
+		// characters other than * are literal
+		{"a.b*", "axb", false},
+		{"a+b*@example.com", "a+b1@example.com", true},
+	}
+	for _, tt := range tests {
+		if got := wildcardPattern(tt.value).MatchString(tt.input); got != tt.want {
+			t.Errorf("wildcardPattern(%q).MatchString(%q) = %v, want %v", tt.value, tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestSuppressionMatcherMatches(t *testing.T) {
+	m := newSuppressionMatcher([]Suppression{
+		{Kind: SuppressionEmail, Value: "jane@example.com"},
+		{Kind: SuppressionDomain, Value: "competitor.com"},
+		{Kind: SuppressionWildcard, Value: "*.spam.net"},
+		{Kind: SuppressionWildcard, Value: "trap-*@example.org"},
+	})
+	tests := []struct {
+		email string
+		want  bool
+	}{
+		{"jane@example.com", true},
+		{" Jane@Example.COM ", true},
+		{"john@example.com", false},
+		{"anyone@competitor.com", true},
+		// a domain entry doesn't cover its subdomains
+		{"anyone@eu.competitor.com", false},
+		{"anyone@mx.spam.net", true},
+		{"anyone@spam.net", false},
+		{"trap-42@example.org", true},
+		{"TRAP-42@example.org", true},
+		{"jane@example.org", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := m.matches(tt.email); got != tt.want {
+			t.Errorf("matches(%q) = %v, want %v", tt.email, got, tt.want)
+		}
+	}
+}
+
+func TestSuppressionMatcherEmpty(t *testing.T) {
+	if newSuppressionMatcher(nil).matches("jane@example.com") {
+		t.Error("an empty suppression list matches jane@example.com")
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+
+	emailVerifier "github.com/AfterShip/email-verifier"
+)
+
+// longest email address allowed by RFC 5321
+const maxEmailLength = 254
+
+const maxListNameLength = 200
+
+// FieldError describes why one field of a request body was rejected
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// fieldErrors collects the problems of a request body so they are reported together
+type fieldErrors []FieldError
+
+func (errs *fieldErrors) add(field string, message string) {
+	*errs = append(*errs, FieldError{Field: field, Message: message})
+}
+
+// err returns the validation_failed error for the collected problems, or nil when there are none
+func (errs fieldErrors) err() error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return &APIError{Status: http.StatusBadRequest, Code: CodeValidationFailed, Message: "request body is invalid", Details: []FieldError(errs)}
+}
+
+// decodeJSONBody decodes the request body into v, rejecting fields v doesn't have,
+// values of the wrong type and anything after the JSON value
+func decodeJSONBody(r *http.Request, v any) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(v)
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case err == nil:
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		var errs fieldErrors
+		errs.add(typeErr.Field, "must be of type "+jsonTypeName(typeErr.Type))
+		return errs.err()
+	case errors.As(err, &typeErr):
+		return &APIError{Status: http.StatusBadRequest, Code: CodeInvalidJSON, Message: "request body must be a JSON " + jsonTypeName(typeErr.Type)}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json has no error type for unknown fields
+		var errs fieldErrors
+		errs.add(strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`), "unknown field")
+		return errs.err()
+	default:
+		return invalidJSON(err)
+	}
+	_, err = decoder.Token()
+	if err != io.EOF {
+		return invalidJSON(errors.New("unexpected data after the JSON value"))
+	}
+	return nil
+}
+
+// jsonTypeName names a Go type the way API clients know it
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Map, reflect.Struct:
+		return "object"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	}
+	return "number"
+}
+
+// validateEmail adds a problem with email to errs, if any
+func validateEmail(errs *fieldErrors, field string, email string) {
+	switch {
+	case email == "":
+		errs.add(field, "is required")
+	case len(email) > maxEmailLength:
+		errs.add(field, "must not be longer than 254 characters")
+	case !emailVerifier.IsAddressValid(email):
+		errs.add(field, "is not a valid email address")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDecodeJSONBody(t *testing.T) {
+	type body struct {
+		Name  string   `json:"name"`
+		Count int      `json:"count"`
+		Tags  []string `json:"tags"`
+	}
+	tests := []struct {
+		name      string
+		body      string
+		wantCode  string
+		wantField string
+		want      body
+	}{
+		{name: "valid", body: `{"name": "a", "count": 2, "tags": ["x"]}`, want: body{Name: "a", Count: 2, Tags: []string{"x"}}},
+		{name: "trailing whitespace", body: "{\"name\": \"a\"}\n", want: body{Name: "a"}},
+		{name: "empty", body: "", wantCode: CodeInvalidJSON},
+		{name: "malformed", body: `{"name": }`, wantCode: CodeInvalidJSON},
+		{name: "not an object", body: `["a"]`, wantCode: CodeInvalidJSON},
+		{name: "unknown field", body: `{"name": "a", "colour": "red"}`, wantCode: CodeValidationFailed, wantField: "colour"},
+		{name: "wrong type", body: `{"count": "two"}`, wantCode: CodeValidationFailed, wantField: "count"},
+		{name: "second value", body: `{"name": "a"} {"name": "b"}`, wantCode: CodeInvalidJSON},
+		{name: "trailing garbage", body: `{"name": "a"} x`, wantCode: CodeInvalidJSON},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			var got body
+			err := decodeJSONBody(r, &got)
+			if tt.wantCode == "" {
+				if err != nil {
+					t.Fatalf("decodeJSONBody(%s) returned %v", tt.body, err)
+				}
+				if got.Name != tt.want.Name || got.Count != tt.want.Count || strings.Join(got.Tags, ",") != strings.Join(tt.want.Tags, ",") {
+					t.Errorf("decodeJSONBody(%s) decoded %+v, want %+v", tt.body, got, tt.want)
+				}
+				return
+			}
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("decodeJSONBody(%s) returned %v, want an *APIError", tt.body, err)
+			}
+			if apiErr.Status != http.StatusBadRequest || apiErr.Code != tt.wantCode {
+				t.Errorf("decodeJSONBody(%s) returned %d %s, want 400 %s", tt.body, apiErr.Status, apiErr.Code, tt.wantCode)
+			}
+			if tt.wantField != "" {
+				details, _ := apiErr.Details.([]FieldError)
+				if len(details) != 1 || details[0].Field != tt.wantField {
+					t.Errorf("decodeJSONBody(%s) returned details %v, want one for %q", tt.body, apiErr.Details, tt.wantField)
+				}
+			}
+		})
+	}
+}
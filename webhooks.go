@@ -0,0 +1,590 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// webhook events
+const (
+	EventListVerificationCompleted = "list.verification.completed"
+	EventLeadVerified              = "lead.verified"
+	EventImportCompleted           = "import.completed"
+	EventImportFailed              = "import.failed"
+)
+
+var allEvents = []string{EventListVerificationCompleted, EventLeadVerified, EventImportCompleted, EventImportFailed}
+
+// events that are delivered in batches, with a list of the data of each event
+var batchedEvents = []string{EventLeadVerified}
+
+// delivery statuses
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+const (
+	// how often the delivery loop looks for due deliveries
+	webhookPollInterval = 5 * time.Second
+	// a delivery is given up after this many attempts
+	webhookMaxAttempts = 8
+	// the first retry waits this long, every further retry twice as long
+	webhookRetryBackoff = 30 * time.Second
+	webhookTimeout      = 10 * time.Second
+	// a claimed delivery is retried after this long, in case its instance died while sending it
+	webhookClaimLease = time.Minute
+	// how many deliveries an instance sends at once, never two to the same webhook
+	webhookWorkers = 8
+	// a batch collects the events of this long, up to webhookBatchSize of them
+	webhookBatchWindow = 10 * time.Second
+	webhookBatchSize   = 500
+	// succeeded and failed deliveries are removed from the delivery log after this long
+	webhookDeliveryRetention = 30 * 24 * time.Hour
+)
+
+// errPrivateWebhookTarget is returned for webhooks that would reach into the network the service runs in
+var errPrivateWebhookTarget = errors.New("url must not point at a loopback, private or link-local address")
+
+// address ranges that are not public but that netip doesn't report as private
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+}
+
+// Webhook subscribes url to events of its workspace. Deliveries are signed with Secret.
+type Webhook struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	WorkspaceID primitive.ObjectID `bson:"workspace_id" json:"workspace_id"`
+	URL         string             `bson:"url" json:"url"`
+	Events      []string           `bson:"events" json:"events"`
+	Secret      string             `bson:"secret" json:"-"`
+	CreatedAt   time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// WebhookDelivery is one event sent, or to be sent, to a webhook
+type WebhookDelivery struct {
+	ID             primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	WorkspaceID    primitive.ObjectID `bson:"workspace_id" json:"workspace_id"`
+	WebhookID      primitive.ObjectID `bson:"webhook_id" json:"webhook_id"`
+	Event          string             `bson:"event" json:"event"`
+	Payload        string             `bson:"payload" json:"payload"`
+	Status         string             `bson:"status" json:"status"`
+	Attempts       int                `bson:"attempts" json:"attempts"`
+	NextAttemptAt  *time.Time         `bson:"next_attempt_at,omitempty" json:"next_attempt_at,omitempty"`
+	ResponseStatus int                `bson:"response_status,omitempty" json:"response_status,omitempty"`
+	LastError      string             `bson:"last_error,omitempty" json:"last_error,omitempty"`
+	CreatedAt      time.Time          `bson:"created_at" json:"created_at"`
+	DeliveredAt    *time.Time         `bson:"delivered_at,omitempty" json:"delivered_at,omitempty"`
+	// when the delivery succeeded or was given up, its retention counts from then
+	FinishedAt *time.Time `bson:"finished_at,omitempty" json:"finished_at,omitempty"`
+	// the data of each event of a batched delivery, the payload is built from it once the batch is sent
+	Batch     []string `bson:"batch,omitempty" json:"-"`
+	BatchSize int      `bson:"batch_size,omitempty" json:"batch_size,omitempty"`
+}
+
+// isPublicAddr reports whether addr is a public unicast address a webhook may be sent to
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// validateWebhook checks the url and events of a new webhook. The url's host must be or
+// resolve to public addresses only.
+func validateWebhook(ctx context.Context, rawURL string, events []string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an absolute http or https url")
+	}
+	host := u.Hostname()
+	addrs := []netip.Addr{}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addrs = append(addrs, addr)
+	} else if strings.EqualFold(host, "localhost") || strings.HasSuffix(strings.ToLower(host), ".localhost") {
+		return errPrivateWebhookTarget
+	} else {
+		lookupCtx, cancel := context.WithTimeout(ctx, webhookTimeout)
+		defer cancel()
+		addrs, err = net.DefaultResolver.LookupNetIP(lookupCtx, "ip", host)
+		if err != nil {
+			return errors.New("url host can't be resolved: " + host)
+		}
+	}
+	for _, addr := range addrs {
+		if !isPublicAddr(addr) {
+			return errPrivateWebhookTarget
+		}
+	}
+	if len(events) == 0 {
+		return errors.New("events are required")
+	}
+	for _, event := range events {
+		if !slices.Contains(allEvents, event) {
+			return errors.New("unknown event: " + event)
+		}
+	}
+	return nil
+}
+
+// CreateWebhook stores a new webhook with a random signing secret and returns it along with the secret
+func CreateWebhook(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, rawURL string, events []string) (Webhook, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	err := validateWebhook(ctx, rawURL, events)
+	if err != nil {
+		return Webhook{}, "", badRequest(err.Error())
+	}
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		return Webhook{}, "", err
+	}
+	webhook := Webhook{
+		WorkspaceID: workspaceID,
+		URL:         rawURL,
+		Events:      events,
+		Secret:      "whsec_" + hex.EncodeToString(b),
+		CreatedAt:   time.Now(),
+	}
+	collection := client.Database(config.Database).Collection("webhooks")
+	res, err := collection.InsertOne(ctx, webhook)
+	if err != nil {
+		return Webhook{}, "", err
+	}
+	webhook.ID = res.InsertedID.(primitive.ObjectID)
+	return webhook, webhook.Secret, nil
+}
+
+func GetWebhooks(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID) ([]Webhook, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("webhooks")
+	cursor, err := collection.Find(ctx, bson.M{"workspace_id": workspaceID})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var webhooks []Webhook
+	for cursor.Next(ctx) {
+		var webhook Webhook
+		cursor.Decode(&webhook)
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, cursor.Err()
+}
+
+// DeleteWebhook removes the webhook, its pending deliveries are dropped when they come up
+func DeleteWebhook(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, id primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("webhooks")
+	res, err := collection.DeleteOne(ctx, bson.M{"_id": id, "workspace_id": workspaceID})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// GetWebhookDeliveries returns the deliveries of the webhook, newest first, optionally
+// only those with status
+func GetWebhookDeliveries(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, webhookID primitive.ObjectID, status string, limit int64) ([]WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	filter := bson.M{"workspace_id": workspaceID, "webhook_id": webhookID}
+	if status != "" {
+		filter["status"] = status
+	}
+	collection := client.Database(config.Database).Collection("webhook_deliveries")
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.M{"_id": -1}).SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	deliveries := []WebhookDelivery{}
+	for cursor.Next(ctx) {
+		var delivery WebhookDelivery
+		cursor.Decode(&delivery)
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, cursor.Err()
+}
+
+// ReplayWebhookDelivery sends the delivery again with a fresh set of attempts, whatever its status
+func ReplayWebhookDelivery(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, webhookID primitive.ObjectID, id primitive.ObjectID) (WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("webhook_deliveries")
+	var delivery WebhookDelivery
+	err := collection.FindOneAndUpdate(ctx,
+		bson.M{"_id": id, "workspace_id": workspaceID, "webhook_id": webhookID},
+		bson.M{"$set": bson.M{"status": DeliveryPending, "attempts": 0, "next_attempt_at": time.Now()}, "$unset": bson.M{"finished_at": ""}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&delivery)
+	return delivery, err
+}
+
+// emitEvent records a delivery of data for every webhook of the workspace subscribed to event.
+// The deliveries are sent by deliverWebhooksPeriodically, so emitting never waits on a receiver.
+// Batched events are added to the webhook's open batch, which is sent webhookBatchWindow after
+// its first event or right away once it is full.
+func emitEvent(ctx context.Context, client *mongo.Client, workspaceID primitive.ObjectID, event string, data any) error {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("webhooks")
+	cursor, err := collection.Find(ctx, bson.M{"workspace_id": workspaceID, "events": event})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	now := time.Now()
+	batched := slices.Contains(batchedEvents, event)
+	var models []mongo.WriteModel
+	for cursor.Next(ctx) {
+		var webhook Webhook
+		cursor.Decode(&webhook)
+		if batched {
+			encoded, err := json.Marshal(data)
+			if err != nil {
+				return err
+			}
+			// a batch takes events until it is claimed or full, either unsets batch_open
+			open := bson.M{"$lt": bson.A{"$batch_size", webhookBatchSize}}
+			models = append(models, mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"webhook_id": webhook.ID, "event": event, "batch_open": true}).
+				SetUpdate(mongo.Pipeline{
+					{{Key: "$set", Value: bson.M{
+						"batch":           bson.M{"$concatArrays": bson.A{bson.M{"$ifNull": bson.A{"$batch", bson.A{}}}, bson.A{bson.M{"$literal": string(encoded)}}}},
+						"batch_size":      bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$batch_size", 0}}, 1}},
+						"workspace_id":    bson.M{"$ifNull": bson.A{"$workspace_id", workspaceID}},
+						"status":          bson.M{"$ifNull": bson.A{"$status", DeliveryPending}},
+						"attempts":        bson.M{"$ifNull": bson.A{"$attempts", 0}},
+						"next_attempt_at": bson.M{"$ifNull": bson.A{"$next_attempt_at", now.Add(webhookBatchWindow)}},
+						"created_at":      bson.M{"$ifNull": bson.A{"$created_at", now}},
+					}}},
+					// a full batch is sent right away
+					{{Key: "$set", Value: bson.M{
+						"batch_open":      bson.M{"$cond": bson.A{open, true, "$$REMOVE"}},
+						"next_attempt_at": bson.M{"$cond": bson.A{open, "$next_attempt_at", now}},
+					}}},
+				}).
+				SetUpsert(true))
+			continue
+		}
+		delivery := WebhookDelivery{
+			ID:            primitive.NewObjectID(),
+			WorkspaceID:   workspaceID,
+			WebhookID:     webhook.ID,
+			Event:         event,
+			Status:        DeliveryPending,
+			NextAttemptAt: &now,
+			CreatedAt:     now,
+		}
+		payload, err := webhookPayload(delivery.ID, event, now, data)
+		if err != nil {
+			return err
+		}
+		delivery.Payload = payload
+		models = append(models, mongo.NewInsertOneModel().SetDocument(delivery))
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	// BulkWrite rejects an empty slice
+	if len(models) == 0 {
+		return nil
+	}
+	deliveries := client.Database(config.Database).Collection("webhook_deliveries")
+	for attempt := 1; ; attempt++ {
+		_, err = deliveries.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		// of two events opening a webhook's batch at once, the unique index only lets one insert
+		// it; the other is written again to add to that batch
+		retry := duplicateBatchWrites(err, models)
+		if len(retry) == 0 || attempt == 3 {
+			return err
+		}
+		models = retry
+	}
+}
+
+// duplicateBatchWrites returns the models of a bulk write that failed on the unique index of
+// open batches, or nil when the write succeeded or failed for any other reason
+func duplicateBatchWrites(err error, models []mongo.WriteModel) []mongo.WriteModel {
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil {
+		return nil
+	}
+	var retry []mongo.WriteModel
+	for _, writeErr := range bulkErr.WriteErrors {
+		if !writeErr.HasErrorCode(11000) {
+			return nil
+		}
+		retry = append(retry, models[writeErr.Index])
+	}
+	return retry
+}
+
+// webhookPayload is the body of a delivery
+func webhookPayload(id primitive.ObjectID, event string, createdAt time.Time, data any) (string, error) {
+	payload, err := json.Marshal(struct {
+		ID        string    `json:"id"`
+		Event     string    `json:"event"`
+		CreatedAt time.Time `json:"created_at"`
+		Data      any       `json:"data"`
+	}{id.Hex(), event, createdAt, data})
+	return string(payload), err
+}
+
+// signWebhookPayload returns the hex HMAC-SHA256 of "<timestamp>.<payload>" keyed with secret
+func signWebhookPayload(secret string, timestamp string, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// claimDueDelivery takes the next delivery that is due, skipping the webhooks in
+// excludeWebhooks. The claim pushes next_attempt_at out by webhookClaimLease so no other
+// instance sends it at the same time, and closes a batch to further events.
+func claimDueDelivery(ctx context.Context, client *mongo.Client, excludeWebhooks []primitive.ObjectID) (WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	now := time.Now()
+	collection := client.Database(config.Database).Collection("webhook_deliveries")
+	var delivery WebhookDelivery
+	err := collection.FindOneAndUpdate(ctx,
+		bson.M{"status": DeliveryPending, "next_attempt_at": bson.M{"$lte": now}, "webhook_id": bson.M{"$nin": excludeWebhooks}},
+		bson.M{"$set": bson.M{"next_attempt_at": now.Add(webhookClaimLease)}, "$unset": bson.M{"batch_open": ""}},
+		options.FindOneAndUpdate().SetSort(bson.M{"next_attempt_at": 1}).SetReturnDocument(options.After),
+	).Decode(&delivery)
+	return delivery, err
+}
+
+// newWebhookHTTPClient returns the client deliveries are sent with. Its dialer refuses
+// non-public addresses, whatever the webhook's host resolves to by the time it is sent
+// and wherever it redirects to.
+func newWebhookHTTPClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: webhookTimeout,
+		Control: func(network string, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !isPublicAddr(addrPort.Addr()) {
+				return errPrivateWebhookTarget
+			}
+			return nil
+		},
+	}
+	transport := &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: webhookTimeout,
+		MaxIdleConnsPerHost: 2,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return &http.Client{Timeout: webhookTimeout, Transport: transport}
+}
+
+// sendWebhookDelivery posts the delivery to its webhook and records the outcome,
+// scheduling a retry with exponential backoff when it failed
+func sendWebhookDelivery(ctx context.Context, client *mongo.Client, httpClient *http.Client, delivery WebhookDelivery) error {
+	collection := client.Database(config.Database).Collection("webhook_deliveries")
+
+	findCtx, cancelFind := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancelFind()
+	var webhook Webhook
+	err := client.Database(config.Database).Collection("webhooks").FindOne(findCtx, bson.M{"_id": delivery.WebhookID}).Decode(&webhook)
+	if err == mongo.ErrNoDocuments {
+		_, err = collection.UpdateOne(findCtx, bson.M{"_id": delivery.ID}, bson.M{
+			"$set":   bson.M{"status": DeliveryFailed, "last_error": "webhook was deleted", "finished_at": time.Now()},
+			"$unset": bson.M{"next_attempt_at": ""},
+		})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	set := bson.M{}
+	unset := bson.M{}
+	// a batch gets its payload when it is first sent, retries send the same one
+	if delivery.Payload == "" && len(delivery.Batch) > 0 {
+		data := make([]json.RawMessage, len(delivery.Batch))
+		for i, item := range delivery.Batch {
+			data[i] = json.RawMessage(item)
+		}
+		delivery.Payload, err = webhookPayload(delivery.ID, delivery.Event, delivery.CreatedAt, data)
+		if err != nil {
+			return err
+		}
+		set["payload"] = delivery.Payload
+		unset["batch"] = ""
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	reqCtx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodPost, webhook.URL, bytes.NewReader([]byte(delivery.Payload)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-ID", webhook.ID.Hex())
+	req.Header.Set("X-Webhook-Event", delivery.Event)
+	req.Header.Set("X-Webhook-Delivery", delivery.ID.Hex())
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", "sha256="+signWebhookPayload(webhook.Secret, timestamp, delivery.Payload))
+
+	attempts := delivery.Attempts + 1
+	set["attempts"] = attempts
+	resp, err := httpClient.Do(req)
+	if err == nil {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+		set["response_status"] = resp.StatusCode
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			err = fmt.Errorf("webhook responded with %d", resp.StatusCode)
+		}
+	}
+
+	switch {
+	case err == nil:
+		set["status"] = DeliverySucceeded
+		set["delivered_at"] = time.Now()
+		set["finished_at"] = set["delivered_at"]
+		unset["next_attempt_at"] = ""
+		unset["last_error"] = ""
+	case attempts >= webhookMaxAttempts:
+		set["status"] = DeliveryFailed
+		set["last_error"] = err.Error()
+		set["finished_at"] = time.Now()
+		unset["next_attempt_at"] = ""
+	default:
+		set["last_error"] = err.Error()
+		set["next_attempt_at"] = time.Now().Add(webhookRetryBackoff << (attempts - 1))
+	}
+	update := bson.M{"$set": set}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	updateCtx, cancelUpdate := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancelUpdate()
+	_, err = collection.UpdateOne(updateCtx, bson.M{"_id": delivery.ID}, update)
+	return err
+}
+
+// deliverWebhooksPeriodically sends due webhook deliveries until ctx is cancelled. Up to
+// webhookWorkers deliveries are sent at once, one per webhook, so a slow receiver only holds
+// up its own deliveries.
+func deliverWebhooksPeriodically(ctx context.Context, client *mongo.Client) {
+	httpClient := newWebhookHTTPClient()
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	semaphore := make(chan struct{}, webhookWorkers)
+	// signals that a delivery finished, which may free up a webhook with due deliveries
+	finished := make(chan struct{}, 1)
+	var mu sync.Mutex
+	busy := make(map[primitive.ObjectID]bool)
+	for {
+	claim:
+		for ctx.Err() == nil {
+			select {
+			case semaphore <- struct{}{}:
+			case <-ctx.Done():
+				break claim
+			}
+			mu.Lock()
+			excludeWebhooks := make([]primitive.ObjectID, 0, len(busy))
+			for id := range busy {
+				excludeWebhooks = append(excludeWebhooks, id)
+			}
+			mu.Unlock()
+			delivery, err := claimDueDelivery(ctx, client, excludeWebhooks)
+			if err != nil {
+				<-semaphore
+				if err != mongo.ErrNoDocuments && ctx.Err() == nil {
+					slog.Error("claiming webhook delivery", "error", err)
+				}
+				break
+			}
+			mu.Lock()
+			busy[delivery.WebhookID] = true
+			mu.Unlock()
+			wg.Add(1)
+			go func(delivery WebhookDelivery) {
+				defer func() {
+					mu.Lock()
+					delete(busy, delivery.WebhookID)
+					mu.Unlock()
+					<-semaphore
+					wg.Done()
+					select {
+					case finished <- struct{}{}:
+					default:
+					}
+				}()
+				err := sendWebhookDelivery(ctx, client, httpClient, delivery)
+				if err != nil {
+					slog.Error("sending webhook delivery", "delivery_id", delivery.ID.Hex(), "webhook_id", delivery.WebhookID.Hex(), "error", err)
+				}
+			}(delivery)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-finished:
+		}
+	}
+}
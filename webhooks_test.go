@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestIsPublicAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"100.64.0.1", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+		// IPv4 addresses written as IPv6 are checked as IPv4
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:93.184.216.34", true},
+	}
+	for _, tt := range tests {
+		if got := isPublicAddr(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("isPublicAddr(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestDuplicateBatchWrites(t *testing.T) {
+	models := []mongo.WriteModel{mongo.NewUpdateOneModel(), mongo.NewUpdateOneModel(), mongo.NewInsertOneModel()}
+	writeErr := func(index int, code int) mongo.BulkWriteError {
+		return mongo.BulkWriteError{WriteError: mongo.WriteError{Index: index, Code: code}}
+	}
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"no error", nil, 0},
+		{"other error", errors.New("connection reset"), 0},
+		{"duplicate open batch", mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{writeErr(1, 11000)}}, 1},
+		{"duplicates and another write error", mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{writeErr(0, 11000), writeErr(2, 121)}}, 0},
+		{"write concern error", mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{writeErr(0, 11000)}, WriteConcernError: &mongo.WriteConcernError{Code: 64}}, 0},
+	}
+	for _, tt := range tests {
+		got := duplicateBatchWrites(tt.err, models)
+		if len(got) != tt.want {
+			t.Errorf("%s: duplicateBatchWrites() returned %d models, want %d", tt.name, len(got), tt.want)
+		}
+		if tt.want == 1 && got[0] != models[1] {
+			t.Errorf("%s: duplicateBatchWrites() returned the wrong model", tt.name)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// defaultWorkspaceName is the workspace that data created before workspaces existed
+// and the bootstrap API key belong to
+const defaultWorkspaceName = "default"
+
+// Workspace isolates the lists, leads, queue items and API keys of one tenant.
+// Every request only sees the data of its API key's workspace.
+type Workspace struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Name      string             `bson:"name" json:"name"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	// verification credits left, nil means unlimited
+	Credits *int64 `bson:"credits,omitempty" json:"credits"`
+	// verifications allowed per calendar month, 0 means unlimited
+	MonthlyQuota int64 `bson:"monthly_quota,omitempty" json:"monthly_quota"`
+	// verifications verified or reserved in QuotaMonth, counted against the monthly quota
+	QuotaMonth string `bson:"quota_month,omitempty" json:"-"`
+	QuotaUsed  int64  `bson:"quota_used,omitempty" json:"-"`
+}
+
+func CreateWorkspace(ctx context.Context, client *mongo.Client, name string) (Workspace, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	workspace := Workspace{Name: name, CreatedAt: time.Now()}
+	collection := client.Database(config.Database).Collection("workspaces")
+	res, err := collection.InsertOne(ctx, workspace)
+	if err != nil {
+		return Workspace{}, err
+	}
+	workspace.ID = res.InsertedID.(primitive.ObjectID)
+	return workspace, nil
+}
+
+func GetWorkspace(ctx context.Context, client *mongo.Client, id primitive.ObjectID) (Workspace, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("workspaces")
+	var workspace Workspace
+	err := collection.FindOne(ctx, bson.M{"_id": id}).Decode(&workspace)
+	return workspace, err
+}
+
+// UpdateWorkspaceCredits sets the credit balance and the monthly quota of the workspace.
+// Nil values are left unchanged, unlimitedCredits removes the balance.
+func UpdateWorkspaceCredits(ctx context.Context, client *mongo.Client, id primitive.ObjectID, credits *int64, unlimitedCredits bool, monthlyQuota *int64) (Workspace, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	set := bson.M{}
+	unset := bson.M{}
+	if unlimitedCredits {
+		unset["credits"] = ""
+	} else if credits != nil {
+		set["credits"] = *credits
+	}
+	if monthlyQuota != nil {
+		set["monthly_quota"] = *monthlyQuota
+	}
+	update := bson.M{}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	if len(update) == 0 {
+		return GetWorkspace(ctx, client, id)
+	}
+
+	collection := client.Database(config.Database).Collection("workspaces")
+	var workspace Workspace
+	err := collection.FindOneAndUpdate(ctx, bson.M{"_id": id}, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&workspace)
+	return workspace, err
+}
+
+func GetWorkspaces(ctx context.Context, client *mongo.Client) ([]Workspace, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.QueryTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("workspaces")
+	cursor, err := collection.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var workspaces []Workspace
+	for cursor.Next(ctx) {
+		var workspace Workspace
+		cursor.Decode(&workspace)
+		workspaces = append(workspaces, workspace)
+	}
+	return workspaces, cursor.Err()
+}
+
+// EnsureDefaultWorkspace returns the default workspace, creating it on the first start,
+// and moves documents stored before workspaces existed into it
+func EnsureDefaultWorkspace(ctx context.Context, client *mongo.Client) (Workspace, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.BulkTimeout)
+	defer cancel()
+
+	collection := client.Database(config.Database).Collection("workspaces")
+	var workspace Workspace
+	err := collection.FindOneAndUpdate(ctx,
+		bson.M{"name": defaultWorkspaceName},
+		bson.M{"$setOnInsert": bson.M{"name": defaultWorkspaceName, "created_at": time.Now()}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&workspace)
+	if err != nil {
+		return Workspace{}, err
+	}
+
+	for _, name := range []string{"lists", "leads", "verification_queue", "api_keys"} {
+		_, err = client.Database(config.Database).Collection(name).UpdateMany(ctx,
+			bson.M{"workspace_id": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"workspace_id": workspace.ID}})
+		if err != nil {
+			return Workspace{}, err
+		}
+	}
+	return workspace, nil
+}